@@ -1,6 +1,8 @@
 package db
 
 import (
+	"crypto/tls"
+	"fmt"
 	"time"
 
 	sql "github.com/go-sql-driver/mysql"
@@ -9,6 +11,12 @@ import (
 	"gorm.io/gorm/logger"
 )
 
+const defaultConnMaxLifetime = 30 * time.Minute
+
+// openDialector opens the mysql dialector of a DSN, replaced by the tests
+var openDialector = mysql.Open
+
+// DB is the global db registered by SetupDBWithConfig with SetGlobal
 var DB *gorm.DB
 
 type DBConfig struct {
@@ -17,13 +25,62 @@ type DBConfig struct {
 	User     string
 	Password string
 	LogLevel string
+
+	// Connection pool, zero MaxOpenConns and MaxIdleConns keep the database/sql
+	// defaults, zero ConnMaxLifetime is 30m (less than the server wait_timeout)
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// Charset and Collation of the connection, such as utf8mb4 and
+	// utf8mb4_general_ci, the driver defaults if empty
+	Charset   string
+	Collation string
+	// Loc is the time zone of the time.Time values, such as Local or
+	// Asia/Shanghai, UTC if empty
+	Loc string
+
+	// Timeout is the dial timeout, ReadTimeout and WriteTimeout the I/O
+	// timeouts, none if zero
+	Timeout      time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// TLS is true, skip-verify, preferred or the name of a config registered
+	// with mysql.RegisterTLSConfig. TLSConfig, if set, is registered and used
+	// instead, under a global name derived from Addr, DBName and the TLSConfig
+	// pointer, so configs of the same database with different TLSConfig do not
+	// replace each other.
+	TLS       string
+	TLSConfig *tls.Config
+
+	// Params are extra DSN params, such as sql_mode or autocommit
+	Params map[string]string
+
+	// SetGlobal registers the db as the global DB returned by GetDB
+	SetGlobal bool
 }
 
+// SetupDB opens a mysql db with the default pool settings
 func SetupDB(addr, dbName, user, passwd, logLevel string) (*gorm.DB, error) {
-	dsn := FormatDSN(addr, dbName, user, passwd)
-	level := formatLogLevel(logLevel)
-	engine, err := gorm.Open(mysql.Open(dsn), &gorm.Config{
-		Logger: logger.Default.LogMode(level),
+	return SetupDBWithConfig(DBConfig{
+		Addr:     addr,
+		DBName:   dbName,
+		User:     user,
+		Password: passwd,
+		LogLevel: logLevel,
+	})
+}
+
+// SetupDBWithConfig opens a mysql db with the DSN and pool settings of conf
+func SetupDBWithConfig(conf DBConfig) (*gorm.DB, error) {
+	dsn, err := conf.FormatDSN()
+	if err != nil {
+		return nil, err
+	}
+	engine, err := gorm.Open(openDialector(dsn), &gorm.Config{
+		Logger: logger.Default.LogMode(formatLogLevel(conf.LogLevel)),
 	})
 	if err != nil {
 		return nil, err
@@ -32,9 +89,24 @@ func SetupDB(addr, dbName, user, passwd, logLevel string) (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	// Set the maximum lifetime of the connection (less than server setting)
-	db.SetConnMaxLifetime(30 * time.Minute)
+	if conf.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(conf.MaxOpenConns)
+	}
+	if conf.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(conf.MaxIdleConns)
+	}
+	lifetime := conf.ConnMaxLifetime
+	if lifetime <= 0 {
+		lifetime = defaultConnMaxLifetime
+	}
+	db.SetConnMaxLifetime(lifetime)
+	if conf.ConnMaxIdleTime > 0 {
+		db.SetConnMaxIdleTime(conf.ConnMaxIdleTime)
+	}
 
+	if conf.SetGlobal {
+		DB = engine
+	}
 	return engine, nil
 }
 
@@ -43,6 +115,9 @@ func GetDB() *gorm.DB {
 }
 
 func Close() error {
+	if DB == nil {
+		return nil
+	}
 	db, err := DB.DB()
 	if err != nil {
 		return err
@@ -64,6 +139,52 @@ func FormatDSN(addr, dbName, user, passwd string) string {
 	return cfg.FormatDSN()
 }
 
+// FormatDSN formats the config into a DSN string which can be passed to the
+// driver, it registers TLSConfig if set. The registration is global to the
+// driver and kept until the process exits.
+func (c *DBConfig) FormatDSN() (string, error) {
+	cfg := sql.Config{
+		User:                 c.User,
+		Passwd:               c.Password,
+		Net:                  "tcp",
+		Addr:                 c.Addr,
+		DBName:               c.DBName,
+		ParseTime:            true,
+		AllowNativePasswords: true,
+		Collation:            c.Collation,
+		Timeout:              c.Timeout,
+		ReadTimeout:          c.ReadTimeout,
+		WriteTimeout:         c.WriteTimeout,
+	}
+	if c.Loc != "" {
+		loc, err := time.LoadLocation(c.Loc)
+		if err != nil {
+			return "", fmt.Errorf("invalid loc %s, err: %v", c.Loc, err)
+		}
+		cfg.Loc = loc
+	}
+
+	cfg.TLSConfig = c.TLS
+	if c.TLSConfig != nil {
+		name := fmt.Sprintf("golib-%s-%s-%p", c.Addr, c.DBName, c.TLSConfig)
+		if err := sql.RegisterTLSConfig(name, c.TLSConfig); err != nil {
+			return "", fmt.Errorf("failed to register tls config, err: %v", err)
+		}
+		cfg.TLSConfig = name
+	}
+
+	if c.Charset != "" || len(c.Params) > 0 {
+		cfg.Params = make(map[string]string, len(c.Params)+1)
+		for k, v := range c.Params {
+			cfg.Params[k] = v
+		}
+		if c.Charset != "" {
+			cfg.Params["charset"] = c.Charset
+		}
+	}
+	return cfg.FormatDSN(), nil
+}
+
 func formatLogLevel(level string) logger.LogLevel {
 	switch level {
 	case "silent":
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"crypto/tls"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	sql "github.com/go-sql-driver/mysql"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+)
+
+func TestDBConfig_FormatDSN(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		conf       DBConfig
+		wantErr    bool
+		wantParams map[string]string
+		wantLoc    *time.Location
+		wantTLS    string
+		check      func(t *testing.T, cfg *sql.Config)
+	}{
+		{
+			name:    "default",
+			conf:    DBConfig{Addr: "127.0.0.1:3306", DBName: "test", User: "root", Password: "pass"},
+			wantLoc: time.UTC,
+			check: func(t *testing.T, cfg *sql.Config) {
+				if cfg.Addr != "127.0.0.1:3306" || cfg.DBName != "test" || cfg.User != "root" || cfg.Passwd != "pass" {
+					t.Errorf("got addr %s, db %s, user %s, passwd %s", cfg.Addr, cfg.DBName, cfg.User, cfg.Passwd)
+				}
+				if !cfg.ParseTime || !cfg.AllowNativePasswords {
+					t.Errorf("got parseTime %v, allowNativePasswords %v", cfg.ParseTime, cfg.AllowNativePasswords)
+				}
+			},
+		},
+		{
+			name:       "charset",
+			conf:       DBConfig{Charset: "utf8mb4", Collation: "utf8mb4_general_ci"},
+			wantParams: map[string]string{"charset": "utf8mb4"},
+			wantLoc:    time.UTC,
+			check: func(t *testing.T, cfg *sql.Config) {
+				if cfg.Collation != "utf8mb4_general_ci" {
+					t.Errorf("got collation %s", cfg.Collation)
+				}
+			},
+		},
+		{
+			name:       "params",
+			conf:       DBConfig{Params: map[string]string{"sql_mode": "'TRADITIONAL'", "autocommit": "1"}},
+			wantParams: map[string]string{"sql_mode": "'TRADITIONAL'", "autocommit": "1"},
+			wantLoc:    time.UTC,
+		},
+		{
+			name:       "charset overrides params",
+			conf:       DBConfig{Charset: "utf8mb4", Params: map[string]string{"charset": "latin1", "autocommit": "1"}},
+			wantParams: map[string]string{"charset": "utf8mb4", "autocommit": "1"},
+			wantLoc:    time.UTC,
+		},
+		{
+			name:    "loc",
+			conf:    DBConfig{Loc: "Asia/Shanghai"},
+			wantLoc: shanghai,
+		},
+		{
+			name:    "invalid loc",
+			conf:    DBConfig{Loc: "Mars/Olympus"},
+			wantErr: true,
+		},
+		{
+			name:    "timeouts",
+			conf:    DBConfig{Timeout: 5 * time.Second, ReadTimeout: 10 * time.Second, WriteTimeout: 15 * time.Second},
+			wantLoc: time.UTC,
+			check: func(t *testing.T, cfg *sql.Config) {
+				if cfg.Timeout != 5*time.Second || cfg.ReadTimeout != 10*time.Second || cfg.WriteTimeout != 15*time.Second {
+					t.Errorf("got timeout %v, read timeout %v, write timeout %v", cfg.Timeout, cfg.ReadTimeout, cfg.WriteTimeout)
+				}
+			},
+		},
+		{
+			name:    "tls",
+			conf:    DBConfig{TLS: "skip-verify"},
+			wantLoc: time.UTC,
+			wantTLS: "skip-verify",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsn, err := tt.conf.FormatDSN()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FormatDSN() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			cfg, err := sql.ParseDSN(dsn)
+			if err != nil {
+				t.Fatalf("failed to parse dsn %s, err: %v", dsn, err)
+			}
+			if len(cfg.Params) != 0 || len(tt.wantParams) != 0 {
+				if !reflect.DeepEqual(cfg.Params, tt.wantParams) {
+					t.Errorf("got params %v, want %v", cfg.Params, tt.wantParams)
+				}
+			}
+			if cfg.Loc.String() != tt.wantLoc.String() {
+				t.Errorf("got loc %v, want %v", cfg.Loc, tt.wantLoc)
+			}
+			if cfg.TLSConfig != tt.wantTLS {
+				t.Errorf("got tls %s, want %s", cfg.TLSConfig, tt.wantTLS)
+			}
+			if tt.check != nil {
+				tt.check(t, cfg)
+			}
+		})
+	}
+}
+
+// configs of the same database with different TLSConfig register different names
+func TestDBConfig_FormatDSNTLSConfig(t *testing.T) {
+	a := DBConfig{Addr: "127.0.0.1:3306", DBName: "test", TLSConfig: &tls.Config{ServerName: "a"}}
+	b := DBConfig{Addr: "127.0.0.1:3306", DBName: "test", TLSConfig: &tls.Config{ServerName: "b"}}
+	names := make([]string, 0, 3)
+	for _, conf := range []DBConfig{a, b, a} {
+		dsn, err := conf.FormatDSN()
+		if err != nil {
+			t.Fatalf("failed to format dsn, err: %v", err)
+		}
+		cfg, err := sql.ParseDSN(dsn)
+		if err != nil {
+			t.Fatalf("failed to parse dsn %s, err: %v", dsn, err)
+		}
+		if !strings.HasPrefix(cfg.TLSConfig, "golib-127.0.0.1:3306-test-") {
+			t.Errorf("got tls name %s", cfg.TLSConfig)
+		}
+		if cfg.TLS == nil {
+			t.Fatalf("tls config %s is not registered", cfg.TLSConfig)
+		}
+		names = append(names, cfg.TLSConfig)
+	}
+	if names[0] == names[1] {
+		t.Errorf("different tls configs got the same name %s", names[0])
+	}
+	if names[0] != names[2] {
+		t.Errorf("the same tls config got names %s and %s", names[0], names[2])
+	}
+}
+
+func TestSetupDBWithConfig(t *testing.T) {
+	mockDB, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mockDB.Close()
+	var dsn string
+	openDialector = func(s string) gorm.Dialector {
+		dsn = s
+		return mysql.New(mysql.Config{Conn: mockDB, SkipInitializeWithVersion: true})
+	}
+	defer func() { openDialector = mysql.Open }()
+	defer func() { DB = nil }()
+
+	conf := DBConfig{Addr: "127.0.0.1:3306", DBName: "test", LogLevel: "silent", MaxOpenConns: 8}
+	engine, err := SetupDBWithConfig(conf)
+	if err != nil {
+		t.Fatalf("failed to setup db, err: %v", err)
+	}
+	if want, _ := conf.FormatDSN(); dsn != want {
+		t.Errorf("got dsn %s, want %s", dsn, want)
+	}
+	if n := mockDB.Stats().MaxOpenConnections; n != 8 {
+		t.Errorf("got max open conns %d, want 8", n)
+	}
+	if GetDB() != nil {
+		t.Errorf("db without SetGlobal is registered")
+	}
+
+	conf.SetGlobal = true
+	engine, err = SetupDBWithConfig(conf)
+	if err != nil {
+		t.Fatalf("failed to setup db, err: %v", err)
+	}
+	if GetDB() != engine {
+		t.Errorf("db with SetGlobal is not registered")
+	}
+}
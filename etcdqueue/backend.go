@@ -0,0 +1,118 @@
+package etcdqueue
+
+import (
+	"context"
+	"strings"
+)
+
+// Backend is the storage of a queue reduced to the primitives the consumers
+// need, so that the same consumer code runs on etcd, Redis or SQL. The keys
+// and revisions are opaque to the callers, a revision is returned by Get,
+// ClaimFirst and Update and passed back for the compare-and-swap of Update
+// and Delete. Queue.Backend returns the etcd implementation, the Redis and
+// MySQL implementations are in the redisbackend and sqlbackend packages.
+type Backend interface {
+	// Name identifies the queue in logs
+	Name() string
+	// Enqueue puts val at the tail of the queue and returns its key
+	Enqueue(ctx context.Context, val string) (string, error)
+	// ClaimFirst removes the first item and returns it. If the queue is
+	// empty, it returns a nil item and a revision to pass to Wait.
+	ClaimFirst(ctx context.Context) (*Item, int64, error)
+	// Wait blocks until an item may have been enqueued after the revision
+	// returned by ClaimFirst, or until ctx is done
+	Wait(ctx context.Context, rev int64) error
+	// Get returns the item of key, or ErrKeyNotFound
+	Get(ctx context.Context, key string) (*Item, error)
+	// Update puts the value of key if it is still at rev and returns the new
+	// revision, it returns ErrKeyNotFound or ErrConflict otherwise
+	Update(ctx context.Context, key, val string, rev int64) (int64, error)
+	// Delete deletes key if it is still at rev, it returns ErrKeyNotFound or
+	// ErrConflict otherwise
+	Delete(ctx context.Context, key string, rev int64) error
+	// Len returns the number of items
+	Len(ctx context.Context) (int64, error)
+}
+
+// DequeueFrom claims the first item of b, blocking until one is available or
+// ctx is done
+func DequeueFrom(ctx context.Context, b Backend) (*Item, error) {
+	for {
+		item, rev, err := b.ClaimFirst(ctx)
+		if err != nil || item != nil {
+			return item, err
+		}
+		// nothing yet; wait on elements
+		if err := b.Wait(ctx, rev); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// RequeueTo puts a failed item back to the tail of b with its attempt count
+// increased, like Requeue without the dead letter queue
+func RequeueTo(ctx context.Context, b Backend, item *Item, err error) error {
+	data, _, merr := encodeRequeue(item, err)
+	if merr != nil {
+		return merr
+	}
+	_, err = b.Enqueue(ctx, data)
+	return err
+}
+
+// etcdBackend is the Backend of a Queue, the keys are the full etcd keys and
+// the revisions the mod revisions
+type etcdBackend struct {
+	q *Queue
+}
+
+// Backend returns the queue as a Backend
+func (q *Queue) Backend() Backend {
+	return &etcdBackend{q: q}
+}
+
+func (b *etcdBackend) Name() string { return b.q.keyPrefix }
+
+func (b *etcdBackend) Enqueue(ctx context.Context, val string) (string, error) {
+	return b.q.EnqueueReturnKeyCtx(ctx, val)
+}
+
+func (b *etcdBackend) ClaimFirst(ctx context.Context) (*Item, int64, error) {
+	kv, rev, err := b.q.tryDequeueKV(ctx)
+	if err != nil || kv == nil {
+		return nil, rev, err
+	}
+	return b.q.claimedItem(ctx, kv), rev, nil
+}
+
+func (b *etcdBackend) Wait(ctx context.Context, rev int64) error {
+	_, err := b.q.waitItemPut(ctx, rev+1)
+	return err
+}
+
+func (b *etcdBackend) Get(ctx context.Context, key string) (*Item, error) {
+	resp, err := b.q.client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return decodeItem(resp.Kvs[0]), nil
+}
+
+func (b *etcdBackend) Update(ctx context.Context, key, val string, rev int64) (int64, error) {
+	return b.q.Store().Update(ctx, b.relative(key), val, rev)
+}
+
+func (b *etcdBackend) Delete(ctx context.Context, key string, rev int64) error {
+	return b.q.Store().Delete(ctx, b.relative(key), rev)
+}
+
+func (b *etcdBackend) Len(ctx context.Context) (int64, error) {
+	return b.q.Len(ctx)
+}
+
+func (b *etcdBackend) relative(key string) string {
+	return strings.TrimPrefix(key, b.q.keyPrefix+"/")
+}
@@ -0,0 +1,25 @@
+package etcdqueue_test
+
+import (
+	"testing"
+
+	"github.com/huweihuang/golib/etcdqueue"
+	"github.com/huweihuang/golib/etcdqueue/backendtest"
+	"github.com/huweihuang/golib/etcdqueue/etcdtest"
+)
+
+// the cases of backendtest import etcdqueue, so they run in the external test
+// package on a server of their own
+func TestQueue_Backend(t *testing.T) {
+	server, err := etcdtest.NewServer()
+	if err != nil {
+		t.Fatalf("failed to start embedded etcd, error: %v", err)
+	}
+	defer server.Close()
+
+	queue, err := etcdqueue.NewEtcdQueue(&etcdqueue.EtcdConfig{Endpoints: server.Endpoints()}, "/backend")
+	if err != nil {
+		t.Fatalf("failed to new etcd queue, error: %v", err)
+	}
+	backendtest.Run(t, queue.Backend())
+}
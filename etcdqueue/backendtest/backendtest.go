@@ -0,0 +1,170 @@
+// Package backendtest checks that an etcdqueue.Backend behaves like the etcd
+// queue, so that every implementation is tested by the same cases.
+package backendtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/huweihuang/golib/etcdqueue"
+)
+
+// Run runs the cases on b, which must be an empty queue
+func Run(t *testing.T, b etcdqueue.Backend) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	t.Run("Order", func(t *testing.T) { testOrder(ctx, t, b) })
+	t.Run("CompareAndSwap", func(t *testing.T) { testCompareAndSwap(ctx, t, b) })
+	t.Run("Wait", func(t *testing.T) { testWait(ctx, t, b) })
+	t.Run("Requeue", func(t *testing.T) { testRequeue(ctx, t, b) })
+	t.Run("Consumer", func(t *testing.T) { testConsumer(ctx, t, b) })
+}
+
+func testOrder(ctx context.Context, t *testing.T, b etcdqueue.Backend) {
+	for _, val := range []string{"a", "b", "c"} {
+		if _, err := b.Enqueue(ctx, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := b.Len(ctx); err != nil || n != 3 {
+		t.Fatalf("Len = %d, %v, want 3", n, err)
+	}
+	for _, want := range []string{"a", "b", "c"} {
+		item, _, err := b.ClaimFirst(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item == nil || item.Value != want {
+			t.Fatalf("ClaimFirst = %+v, want %s", item, want)
+		}
+	}
+	if item, _, err := b.ClaimFirst(ctx); err != nil || item != nil {
+		t.Fatalf("ClaimFirst of empty queue = %+v, %v", item, err)
+	}
+}
+
+func testCompareAndSwap(ctx context.Context, t *testing.T, b etcdqueue.Backend) {
+	key, err := b.Enqueue(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := b.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Key != key || item.Value != "a" {
+		t.Fatalf("Get = %+v", item)
+	}
+	rev, err := b.Update(ctx, key, "b", item.Revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Update(ctx, key, "c", item.Revision); err != etcdqueue.ErrConflict {
+		t.Fatalf("Update at an old revision = %v, want ErrConflict", err)
+	}
+	if err := b.Delete(ctx, key, item.Revision); err != etcdqueue.ErrConflict {
+		t.Fatalf("Delete at an old revision = %v, want ErrConflict", err)
+	}
+	if item, err := b.Get(ctx, key); err != nil || item.Value != "b" || item.Revision != rev {
+		t.Fatalf("Get after Update = %+v, %v", item, err)
+	}
+	if err := b.Delete(ctx, key, rev); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Get(ctx, key); err != etcdqueue.ErrKeyNotFound {
+		t.Fatalf("Get after Delete = %v, want ErrKeyNotFound", err)
+	}
+	if _, err := b.Update(ctx, key, "d", rev); err != etcdqueue.ErrKeyNotFound {
+		t.Fatalf("Update after Delete = %v, want ErrKeyNotFound", err)
+	}
+	if item, _, err := b.ClaimFirst(ctx); err != nil || item != nil {
+		t.Fatalf("ClaimFirst returned the deleted item: %+v, %v", item, err)
+	}
+}
+
+func testWait(ctx context.Context, t *testing.T, b etcdqueue.Backend) {
+	item, rev, err := b.ClaimFirst(ctx)
+	if err != nil || item != nil {
+		t.Fatalf("ClaimFirst of empty queue = %+v, %v", item, err)
+	}
+	ctx1, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if err := b.Wait(ctx1, rev); err != context.DeadlineExceeded {
+		t.Fatalf("Wait on empty queue = %v, want DeadlineExceeded", err)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		b.Enqueue(ctx, "a")
+	}()
+	item, err = etcdqueue.DequeueFrom(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Value != "a" {
+		t.Fatalf("DequeueFrom = %+v, want a", item)
+	}
+}
+
+func testRequeue(ctx context.Context, t *testing.T, b etcdqueue.Backend) {
+	if _, err := b.Enqueue(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	item, err := etcdqueue.DequeueFrom(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := etcdqueue.RequeueTo(ctx, b, item, errors.New("boom")); err != nil {
+		t.Fatal(err)
+	}
+	item, err = etcdqueue.DequeueFrom(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Value != "a" || item.Attempts != 1 || item.LastError != "boom" {
+		t.Fatalf("requeued item = %+v", item)
+	}
+}
+
+func testConsumer(ctx context.Context, t *testing.T, b etcdqueue.Backend) {
+	for _, val := range []string{"a", "b", "fail"} {
+		if _, err := b.Enqueue(ctx, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handled := make(chan etcdqueue.Item, 10)
+	handler := func(ctx context.Context, item etcdqueue.Item) error {
+		if item.Value == "fail" && item.Attempts == 0 {
+			return errors.New("first attempt")
+		}
+		handled <- item
+		return nil
+	}
+	c := etcdqueue.NewBackendConsumer(b, handler, etcdqueue.ConsumerConfig{Concurrency: 2})
+	ctx1, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx1) }()
+
+	seen := make(map[string]int)
+	for len(seen) < 3 {
+		select {
+		case item := <-handled:
+			seen[item.Value] = item.Attempts
+		case <-ctx.Done():
+			t.Fatalf("handled %v before timeout", seen)
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if seen["fail"] != 1 {
+		t.Fatalf("retried item handled with %d attempts, want 1", seen["fail"])
+	}
+	if n, err := b.Len(ctx); err != nil || n != 0 {
+		t.Fatalf("Len after consumer = %d, %v, want 0", n, err)
+	}
+}
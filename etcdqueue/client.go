@@ -16,16 +16,21 @@ package etcdqueue
 
 import (
 	"fmt"
+	"os"
 	"strings"
 	"time"
 
 	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/namespace"
 	"github.com/coreos/etcd/pkg/transport"
+	"github.com/spf13/pflag"
 )
 
 var (
 	defaultDialTimeout      = 10 * time.Second
 	defaultAotuSyncInterval = 10 * time.Second
+	defaultKeepAliveTime    = 2 * time.Second
+	defaultKeepAliveTimeout = 6 * time.Second
 )
 
 // EtcdConfig etcd client arguments
@@ -36,6 +41,65 @@ type EtcdConfig struct {
 	CaFile           string        // args for clientv3.Config.TLS
 	CertFile         string        // args for clientv3.Config.TLS
 	KeyFile          string        // args for clientv3.Config.TLS
+
+	Username           string        // args for clientv3.Config
+	Password           string        // args for clientv3.Config
+	ServerName         string        // args for clientv3.Config.TLS, overrides the server name to verify
+	InsecureSkipVerify bool          // args for clientv3.Config.TLS
+	KeepAliveTime      time.Duration // args for clientv3.Config, 2s by default
+	KeepAliveTimeout   time.Duration // args for clientv3.Config, 6s by default
+	MaxCallSendMsgSize int           // args for clientv3.Config, 2MiB by default
+	MaxCallRecvMsgSize int           // args for clientv3.Config, unlimited by default
+	// Namespace is prepended to all keys of the client with clientv3/namespace
+	Namespace string
+}
+
+// AddFlags adds the etcd flags to fs, the current values are the defaults
+func (c *EtcdConfig) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&c.Endpoints, "etcd-endpoints", c.Endpoints, "Comma separated etcd endpoints.")
+	fs.DurationVar(&c.DialTimeout, "etcd-dial-timeout", c.DialTimeout, "Timeout to connect to etcd, 10s if zero.")
+	fs.DurationVar(&c.AutoSyncInterval, "etcd-auto-sync-interval", c.AutoSyncInterval,
+		"Interval to update the endpoints with the etcd members, 10s if zero.")
+	fs.StringVar(&c.CaFile, "etcd-cafile", c.CaFile, "CA file to verify the etcd server, enables TLS.")
+	fs.StringVar(&c.CertFile, "etcd-certfile", c.CertFile, "Client certificate file, enables TLS.")
+	fs.StringVar(&c.KeyFile, "etcd-keyfile", c.KeyFile, "Client key file, enables TLS.")
+	fs.StringVar(&c.Username, "etcd-username", c.Username, "Username for etcd authentication.")
+	fs.StringVar(&c.Password, "etcd-password", c.Password, "Password for etcd authentication.")
+	fs.StringVar(&c.ServerName, "etcd-server-name", c.ServerName, "Server name to verify the etcd certificate with.")
+	fs.BoolVar(&c.InsecureSkipVerify, "etcd-insecure-skip-verify", c.InsecureSkipVerify,
+		"Skip verifying the etcd certificate, enables TLS.")
+	fs.DurationVar(&c.KeepAliveTime, "etcd-keepalive-time", c.KeepAliveTime,
+		"Interval of the client keepalive pings, 2s if zero.")
+	fs.DurationVar(&c.KeepAliveTimeout, "etcd-keepalive-timeout", c.KeepAliveTimeout,
+		"Timeout of the client keepalive pings, 6s if zero.")
+	fs.IntVar(&c.MaxCallSendMsgSize, "etcd-max-call-send-msg-size", c.MaxCallSendMsgSize,
+		"Max request size in bytes, 2MiB if zero.")
+	fs.IntVar(&c.MaxCallRecvMsgSize, "etcd-max-call-recv-msg-size", c.MaxCallRecvMsgSize,
+		"Max response size in bytes, unlimited if zero.")
+	fs.StringVar(&c.Namespace, "etcd-namespace", c.Namespace, "Prefix prepended to all etcd keys.")
+}
+
+// LoadEnv sets the config from the environment variables named after the
+// flags, such as ETCD_ENDPOINTS for --etcd-endpoints. Call it before AddFlags
+// so that the flags override the environment.
+func (c *EtcdConfig) LoadEnv() error {
+	fs := pflag.NewFlagSet("etcd", pflag.ContinueOnError)
+	c.AddFlags(fs)
+	var err error
+	fs.VisitAll(func(f *pflag.Flag) {
+		env := strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		if val, ok := os.LookupEnv(env); ok && err == nil {
+			if serr := fs.Set(f.Name, val); serr != nil {
+				err = fmt.Errorf("invalid %s, err: %v", env, serr)
+			}
+		}
+	})
+	return err
+}
+
+// tlsEnabled returns whether any TLS argument is set
+func (c *EtcdConfig) tlsEnabled() bool {
+	return c.CaFile != "" || c.CertFile != "" || c.KeyFile != "" || c.ServerName != "" || c.InsecureSkipVerify
 }
 
 // NewETCDClient new etcd client v3
@@ -43,31 +107,46 @@ func NewETCDClient(etcdConfig *EtcdConfig) (*v3.Client, error) {
 	if etcdConfig.Endpoints == "" {
 		return nil, fmt.Errorf("no endpoints specified")
 	}
-	if etcdConfig.DialTimeout <= 10 {
+	if etcdConfig.DialTimeout <= 0 {
 		etcdConfig.DialTimeout = defaultDialTimeout
 	}
-	if etcdConfig.AutoSyncInterval <= 30 {
+	if etcdConfig.AutoSyncInterval <= 0 {
 		etcdConfig.AutoSyncInterval = defaultAotuSyncInterval
 	}
+	if etcdConfig.KeepAliveTime <= 0 {
+		etcdConfig.KeepAliveTime = defaultKeepAliveTime
+	}
+	if etcdConfig.KeepAliveTimeout <= 0 {
+		etcdConfig.KeepAliveTimeout = defaultKeepAliveTimeout
+	}
 
 	config := v3.Config{
 		Endpoints:            strings.Split(etcdConfig.Endpoints, ","),
 		DialTimeout:          etcdConfig.DialTimeout,
-		DialKeepAliveTime:    time.Second * 2,
-		DialKeepAliveTimeout: time.Second * 6,
+		DialKeepAliveTime:    etcdConfig.KeepAliveTime,
+		DialKeepAliveTimeout: etcdConfig.KeepAliveTimeout,
 		AutoSyncInterval:     etcdConfig.AutoSyncInterval,
+		MaxCallSendMsgSize:   etcdConfig.MaxCallSendMsgSize,
+		MaxCallRecvMsgSize:   etcdConfig.MaxCallRecvMsgSize,
+		Username:             etcdConfig.Username,
+		Password:             etcdConfig.Password,
 	}
 
-	if etcdConfig.CaFile != "" && etcdConfig.KeyFile != "" && etcdConfig.CertFile != "" {
+	if etcdConfig.tlsEnabled() {
+		if (etcdConfig.CertFile == "") != (etcdConfig.KeyFile == "") {
+			return nil, fmt.Errorf("certfile and keyfile must be specified together")
+		}
 		tlsInfo := transport.TLSInfo{
-			CertFile:      etcdConfig.CertFile,
-			KeyFile:       etcdConfig.KeyFile,
-			TrustedCAFile: etcdConfig.CaFile,
+			CertFile:           etcdConfig.CertFile,
+			KeyFile:            etcdConfig.KeyFile,
+			TrustedCAFile:      etcdConfig.CaFile,
+			ServerName:         etcdConfig.ServerName,
+			InsecureSkipVerify: etcdConfig.InsecureSkipVerify,
 		}
 
 		tlsConfig, err := tlsInfo.ClientConfig()
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate tlsConfig")
+			return nil, fmt.Errorf("failed to generate tlsConfig, err: %v", err)
 		}
 		config.TLS = tlsConfig
 	}
@@ -76,15 +155,20 @@ func NewETCDClient(etcdConfig *EtcdConfig) (*v3.Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	if etcdConfig.Namespace != "" {
+		cli.KV = namespace.NewKV(cli.KV, etcdConfig.Namespace)
+		cli.Watcher = namespace.NewWatcher(cli.Watcher, etcdConfig.Namespace)
+		cli.Lease = namespace.NewLease(cli.Lease, etcdConfig.Namespace)
+	}
 	return cli, nil
 }
 
 // NewEtcdQueue new a etcd queue
-func NewEtcdQueue(etcdConfig *EtcdConfig, keyPrefix string) (*Queue, error) {
+func NewEtcdQueue(etcdConfig *EtcdConfig, keyPrefix string, opts ...QueueOption) (*Queue, error) {
 	etcdClient, err := NewETCDClient(etcdConfig)
 	if err != nil {
-		return nil, fmt.Errorf("faied to new etcd client")
+		return nil, fmt.Errorf("failed to new etcd client, err: %v", err)
 	}
-	queue := NewQueue(etcdClient, keyPrefix)
+	queue := NewQueue(etcdClient, keyPrefix, opts...)
 	return queue, nil
 }
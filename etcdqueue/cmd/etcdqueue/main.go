@@ -0,0 +1,356 @@
+// etcdqueue inspects and repairs the etcd queues, all results are printed as
+// JSON to stdout.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/spf13/pflag"
+
+	"github.com/huweihuang/golib/etcdqueue"
+)
+
+const usage = `Usage: etcdqueue [flags] <command> [args]
+
+Commands:
+  push <value>...      enqueue the values
+  pop                  dequeue an item, waiting up to --timeout
+  peek                 show up to --count items in dequeue order
+  len                  show the number of items by state
+  list                 list the items sorted by key, up to --count if set
+  purge                delete all items, in-flight and dead letter items are kept
+  move <from> <to>     move the items of the queue <from> to the tail of <to>, up to --count if set
+  dlq list             list the dead letters
+  dlq replay [key]     move a dead letter, or all of them, back to the queue
+  dlq purge            delete all dead letters
+  watch                print the changes of the items until interrupted
+  export               write all keys of the queue to stdout as newline delimited JSON
+  import               create the keys written by export from stdin
+
+The etcd flags can also be set by environment variables, such as ETCD_ENDPOINTS.
+
+Flags:
+`
+
+// stdin and stdout of the commands, replaced by the tests
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+)
+
+type options struct {
+	etcd     etcdqueue.EtcdConfig
+	prefix   string
+	ordering string
+	count    int
+	timeout  time.Duration
+}
+
+// item is the JSON output of a queue item
+type item struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Attempts  int    `json:"attempts,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+	Revision  int64  `json:"revision"`
+}
+
+// event is the JSON output of a queue event
+type event struct {
+	Type     string `json:"type"`
+	Key      string `json:"key,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Revision int64  `json:"revision"`
+	Error    string `json:"error,omitempty"`
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	o := &options{}
+	if err := o.etcd.LoadEnv(); err != nil {
+		return err
+	}
+	fs := pflag.NewFlagSet("etcdqueue", pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	o.etcd.AddFlags(fs)
+	fs.StringVar(&o.prefix, "prefix", "", "Key prefix of the queue.")
+	fs.StringVar(&o.ordering, "ordering", "timestamp", "Ordering of the queue, timestamp or sequence.")
+	fs.IntVarP(&o.count, "count", "n", 0, "Number of items of peek, list and move, peek shows 1 if zero.")
+	fs.DurationVar(&o.timeout, "timeout", 10*time.Second, "Timeout of the command, watch runs until interrupted.")
+	if err := fs.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no command")
+	}
+	if o.etcd.Endpoints == "" {
+		return errors.New("--etcd-endpoints is required")
+	}
+
+	client, err := etcdqueue.NewETCDClient(&o.etcd)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	if cmd != "watch" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+
+	if cmd == "move" {
+		if len(cmdArgs) != 2 {
+			return errors.New("usage: move <from> <to>")
+		}
+		from, err := o.newQueue(client, cmdArgs[0])
+		if err != nil {
+			return err
+		}
+		to, err := o.newQueue(client, cmdArgs[1])
+		if err != nil {
+			return err
+		}
+		n, err := from.MoveTo(ctx, to, o.count)
+		if err != nil {
+			return err
+		}
+		return printJSON(map[string]int{"moved": n})
+	}
+
+	if o.prefix == "" {
+		return errors.New("--prefix is required")
+	}
+	q, err := o.newQueue(client, o.prefix)
+	if err != nil {
+		return err
+	}
+	switch cmd {
+	case "push":
+		return push(ctx, q, cmdArgs)
+	case "pop":
+		return pop(ctx, q)
+	case "peek":
+		return peek(ctx, q, o.count)
+	case "len":
+		return length(ctx, q)
+	case "list":
+		return list(ctx, q, o.count)
+	case "purge":
+		n, err := q.Purge(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(map[string]int64{"deleted": n})
+	case "dlq":
+		return deadLetter(ctx, q, cmdArgs)
+	case "watch":
+		return watch(ctx, q)
+	case "export":
+		_, err := q.Export(ctx, stdout)
+		return err
+	case "import":
+		n, err := q.Import(ctx, stdin)
+		if err != nil {
+			return err
+		}
+		return printJSON(map[string]int{"imported": n})
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+func (o *options) newQueue(client *v3.Client, prefix string) (*etcdqueue.Queue, error) {
+	var ordering etcdqueue.Ordering
+	switch o.ordering {
+	case "timestamp":
+		ordering = etcdqueue.OrderTimestamp
+	case "sequence":
+		ordering = etcdqueue.OrderSequence
+	default:
+		return nil, fmt.Errorf("invalid ordering %q", o.ordering)
+	}
+	return etcdqueue.NewQueue(client, strings.TrimSuffix(prefix, "/"), etcdqueue.WithOrdering(ordering)), nil
+}
+
+func push(ctx context.Context, q *etcdqueue.Queue, vals []string) error {
+	if len(vals) == 0 {
+		return errors.New("usage: push <value>...")
+	}
+	keys := make([]string, 0, len(vals))
+	for _, val := range vals {
+		key, err := q.EnqueueReturnKeyCtx(ctx, val)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	return printJSON(map[string][]string{"keys": keys})
+}
+
+func pop(ctx context.Context, q *etcdqueue.Queue) error {
+	it, err := q.DequeueItem(ctx)
+	if err == nil {
+		return printJSON(toItem(it))
+	}
+	// only the --timeout is an empty queue, an interrupt returns its cause
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return errors.New("queue is empty")
+	}
+	return err
+}
+
+func peek(ctx context.Context, q *etcdqueue.Queue, n int) error {
+	if n <= 0 {
+		n = 1
+	}
+	items, err := q.Peek(ctx, n)
+	if err != nil {
+		return err
+	}
+	return printJSON(toItems(items))
+}
+
+func length(ctx context.Context, q *etcdqueue.Queue) error {
+	stats, err := q.Stats(ctx)
+	if err != nil {
+		return err
+	}
+	return printJSON(map[string]interface{}{
+		"len":         stats.Len,
+		"inflight":    stats.InFlight,
+		"deadLetters": stats.DeadLetters,
+		"delayed":     stats.Delayed,
+		"oldestKey":   stats.OldestKey,
+		"oldestAge":   stats.OldestAge.String(),
+		"revision":    stats.Revision,
+	})
+}
+
+func list(ctx context.Context, q *etcdqueue.Queue, n int) error {
+	var items []*etcdqueue.Item
+	cursor := ""
+	for {
+		// zero is the page size of the package
+		page, next, err := q.List(ctx, cursor, 0)
+		if err != nil {
+			return err
+		}
+		items = append(items, page...)
+		if n > 0 && len(items) >= n {
+			return printJSON(toItems(items[:n]))
+		}
+		if next == "" {
+			return printJSON(toItems(items))
+		}
+		cursor = next
+	}
+}
+
+func deadLetter(ctx context.Context, q *etcdqueue.Queue, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: dlq list|replay [key]|purge")
+	}
+	switch args[0] {
+	case "list":
+		items, err := q.ListDeadLetters(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(toItems(items))
+	case "replay":
+		if len(args) == 1 {
+			n, err := q.ReplayDeadLetters(ctx)
+			if err != nil {
+				return err
+			}
+			return printJSON(map[string]int{"replayed": n})
+		}
+		it, err := q.GetDeadLetter(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		ok, err := q.ReplayDeadLetter(ctx, it)
+		if err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("dead letter %s was modified, retry", args[1])
+		}
+		return printJSON(map[string]int{"replayed": 1})
+	case "purge":
+		n, err := q.PurgeDeadLetters(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(map[string]int64{"deleted": n})
+	}
+	return fmt.Errorf("unknown dlq command %q", args[0])
+}
+
+// watch prints one event per line
+func watch(ctx context.Context, q *etcdqueue.Queue) error {
+	events, err := q.Watch(ctx)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(stdout)
+	for ev := range events {
+		out := event{Type: ev.Type.String(), Key: ev.Key, Value: ev.Value, Revision: ev.Revision}
+		if ev.Err != nil {
+			out.Error = ev.Err.Error()
+		}
+		if err := enc.Encode(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func toItem(it *etcdqueue.Item) item {
+	return item{
+		Key:       it.Key,
+		Value:     it.Value,
+		Attempts:  it.Attempts,
+		LastError: it.LastError,
+		Revision:  it.Revision,
+	}
+}
+
+func toItems(items []*etcdqueue.Item) []item {
+	out := make([]item, 0, len(items))
+	for _, it := range items {
+		out = append(out, toItem(it))
+	}
+	return out
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
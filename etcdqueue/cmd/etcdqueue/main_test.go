@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/huweihuang/golib/etcdqueue"
+	"github.com/huweihuang/golib/etcdqueue/etcdtest"
+)
+
+func TestRun(t *testing.T) {
+	server, err := etcdtest.NewServer()
+	if err != nil {
+		t.Fatalf("failed to start embedded etcd, error: %v", err)
+	}
+	defer server.Close()
+
+	var out bytes.Buffer
+	stdout = &out
+	runCmd := func(result interface{}, args ...string) error {
+		out.Reset()
+		args = append([]string{"--etcd-endpoints", server.Endpoints(), "--prefix", "/clitest",
+			"--timeout", "1s"}, args...)
+		if err := run(args); err != nil {
+			return err
+		}
+		return json.Unmarshal(out.Bytes(), result)
+	}
+
+	var pushed map[string][]string
+	if err := runCmd(&pushed, "push", "a", "b"); err != nil {
+		t.Fatalf("failed to push, error: %v", err)
+	}
+	if len(pushed["keys"]) != 2 {
+		t.Fatalf("push got %v, want 2 keys", pushed)
+	}
+
+	var stats map[string]interface{}
+	if err := runCmd(&stats, "len"); err != nil {
+		t.Fatalf("failed to len, error: %v", err)
+	}
+	if stats["len"] != float64(2) {
+		t.Errorf("len got %v, want 2", stats["len"])
+	}
+
+	var listed []item
+	if err := runCmd(&listed, "list", "-n", "1"); err != nil {
+		t.Fatalf("failed to list, error: %v", err)
+	}
+	if len(listed) != 1 || listed[0].Value != "a" {
+		t.Errorf("list -n 1 got %+v, want a", listed)
+	}
+
+	for i, want := range []string{"a", "b"} {
+		var popped item
+		if err := runCmd(&popped, "pop"); err != nil {
+			t.Fatalf("failed to pop, error: %v", err)
+		}
+		if popped.Value != want || popped.Key != pushed["keys"][i] {
+			t.Errorf("pop got %+v, want %s at %s", popped, want, pushed["keys"][i])
+		}
+	}
+	if err := runCmd(&item{}, "pop"); err == nil || err.Error() != "queue is empty" {
+		t.Errorf("pop of empty queue got %v, want queue is empty", err)
+	}
+
+	// move and purge
+	if err := runCmd(&pushed, "push", "c", "d", "e"); err != nil {
+		t.Fatalf("failed to push, error: %v", err)
+	}
+	var moved map[string]int
+	if err := runCmd(&moved, "move", "/clitest", "/clitestdst", "-n", "2"); err != nil {
+		t.Fatalf("failed to move, error: %v", err)
+	}
+	if moved["moved"] != 2 {
+		t.Errorf("move -n 2 got %v, want 2", moved)
+	}
+	if err := runCmd(&listed, "list", "--prefix", "/clitestdst"); err != nil {
+		t.Fatalf("failed to list, error: %v", err)
+	}
+	if len(listed) != 2 || listed[0].Value != "c" || listed[1].Value != "d" {
+		t.Errorf("list of moved items got %+v, want c and d", listed)
+	}
+	var purged map[string]int
+	if err := runCmd(&purged, "purge"); err != nil {
+		t.Fatalf("failed to purge, error: %v", err)
+	}
+	if purged["deleted"] != 1 {
+		t.Errorf("purge got %v, want 1", purged)
+	}
+	if err := runCmd(&stats, "len"); err != nil {
+		t.Fatalf("failed to len, error: %v", err)
+	}
+	if stats["len"] != float64(0) {
+		t.Errorf("len after purge got %v, want 0", stats["len"])
+	}
+
+	// dlq list and replay
+	client, err := etcdqueue.NewETCDClient(&etcdqueue.EtcdConfig{Endpoints: server.Endpoints()})
+	if err != nil {
+		t.Fatalf("failed to new etcd client, error: %v", err)
+	}
+	defer client.Close()
+	q := etcdqueue.NewQueue(client, "/clitest", etcdqueue.WithMaxAttempts(1))
+	for _, val := range []string{"f", "g"} {
+		if err := q.Enqueue(val); err != nil {
+			t.Fatalf("failed to enqueue, error: %v", err)
+		}
+		it, err := q.DequeueItem(context.Background())
+		if err != nil {
+			t.Fatalf("failed to dequeue, error: %v", err)
+		}
+		if err := q.Requeue(it, errors.New("failed")); err != nil {
+			t.Fatalf("failed to requeue, error: %v", err)
+		}
+	}
+	var dead []item
+	if err := runCmd(&dead, "dlq", "list"); err != nil {
+		t.Fatalf("failed to list dead letters, error: %v", err)
+	}
+	if len(dead) != 2 || dead[0].Value != "f" || dead[0].LastError != "failed" {
+		t.Fatalf("dlq list got %+v, want f and g", dead)
+	}
+	var replayed map[string]int
+	if err := runCmd(&replayed, "dlq", "replay", dead[0].Key); err != nil {
+		t.Fatalf("failed to replay, error: %v", err)
+	}
+	if replayed["replayed"] != 1 {
+		t.Errorf("dlq replay <key> got %v, want 1", replayed)
+	}
+	if err := runCmd(&replayed, "dlq", "replay"); err != nil {
+		t.Fatalf("failed to replay, error: %v", err)
+	}
+	if replayed["replayed"] != 1 {
+		t.Errorf("dlq replay got %v, want 1", replayed)
+	}
+	if err := runCmd(&listed, "list"); err != nil {
+		t.Fatalf("failed to list, error: %v", err)
+	}
+	if len(listed) != 2 || listed[0].Value != "f" || listed[1].Value != "g" {
+		t.Errorf("list of replayed items got %+v, want f and g", listed)
+	}
+
+	// an interrupted pop is not an empty queue
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := pop(ctx, etcdqueue.NewQueue(client, "/clitestempty")); !errors.Is(err, context.Canceled) {
+		t.Errorf("interrupted pop got %v, want context canceled", err)
+	}
+}
@@ -0,0 +1,117 @@
+package etcdqueue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// gzipMagic is the header of a gzip stream, used to tell compressed values apart
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Codec converts the values of a TypedQueue to and from the stored bytes
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// DecodeError is returned when a stored value can not be decoded, it keeps
+// the raw value so that the item is not lost.
+type DecodeError struct {
+	Key   string
+	Value []byte
+	Err   error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("failed to decode item %s, err: %v", e.Key, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+// JSONCodec encodes values with encoding/json
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// ProtobufCodec encodes protobuf messages, v must be a proto.Message or a
+// pointer to one, which is allocated if nil.
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		// a *T with T a message pointer, as passed by TypedQueue[*Message]
+		rv := reflect.ValueOf(v)
+		if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Ptr {
+			return fmt.Errorf("%T is not a proto.Message", v)
+		}
+		if rv.Elem().IsNil() {
+			rv.Elem().Set(reflect.New(rv.Elem().Type().Elem()))
+		}
+		if m, ok = rv.Elem().Interface().(proto.Message); !ok {
+			return fmt.Errorf("%T is not a proto.Message", v)
+		}
+	}
+	return proto.Unmarshal(data, m)
+}
+
+// MsgpackCodec encodes values with msgpack
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) { return msgpack.Marshal(v) }
+
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error { return msgpack.Unmarshal(data, v) }
+
+// GzipCodec compresses the values of Codec which are at least MinSize bytes,
+// smaller values are stored as is. Unmarshal accepts both.
+type GzipCodec struct {
+	Codec   Codec
+	MinSize int
+}
+
+func (c GzipCodec) Marshal(v interface{}) ([]byte, error) {
+	data, err := c.Codec.Marshal(v)
+	if err != nil || len(data) < c.MinSize {
+		return data, err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c GzipCodec) Unmarshal(data []byte, v interface{}) error {
+	if bytes.HasPrefix(data, gzipMagic) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		if data, err = io.ReadAll(zr); err != nil {
+			return err
+		}
+	}
+	return c.Codec.Unmarshal(data, v)
+}
@@ -0,0 +1,190 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultRetryInterval = time.Second
+
+// Handler processes a dequeued item, a returned error or a panic requeues the item
+type Handler func(ctx context.Context, item Item) error
+
+// ConsumerConfig consumer arguments
+type ConsumerConfig struct {
+	// Concurrency is the number of workers, each worker dequeues and handles
+	// one item at a time, so it is also the limit of concurrent handlers.
+	Concurrency int
+	// Timeout is the per item handler timeout, no timeout if zero
+	Timeout time.Duration
+	// VisibilityTimeout makes the workers Reserve items instead of Dequeue
+	// them, so that the items of a crashed worker are redelivered. The queue
+	// must run RunRedelivery somewhere. A live worker keeps its item for as
+	// long as the handler runs, bound it with Timeout. It is ignored by the
+	// consumers of a Backend.
+	VisibilityTimeout time.Duration
+	// ShutdownTimeout is how long Run waits for in-flight handlers after ctx
+	// is done before cancelling their contexts, wait forever if zero.
+	ShutdownTimeout time.Duration
+	// RetryInterval is the wait after a failed dequeue, 1s by default
+	RetryInterval time.Duration
+}
+
+// Consumer runs a pool of workers which dequeue items and call the handler
+type Consumer struct {
+	queue   *Queue
+	backend Backend
+	handler Handler
+	config  ConsumerConfig
+}
+
+// NewConsumer new a consumer of the queue
+func NewConsumer(queue *Queue, handler Handler, config ConsumerConfig) *Consumer {
+	c := newConsumer(queue.Backend(), handler, config)
+	c.queue = queue
+	return c
+}
+
+// NewBackendConsumer new a consumer of a Backend, such as Redis or SQL. A
+// failed item is put back to the tail of the queue with its attempt count
+// increased, the backends have no dead letter queue, so the handler gives up
+// on an item by returning nil for it.
+func NewBackendConsumer(backend Backend, handler Handler, config ConsumerConfig) *Consumer {
+	return newConsumer(backend, handler, config)
+}
+
+func newConsumer(backend Backend, handler Handler, config ConsumerConfig) *Consumer {
+	if config.Concurrency <= 0 {
+		config.Concurrency = 1
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = defaultRetryInterval
+	}
+	return &Consumer{backend: backend, handler: handler, config: config}
+}
+
+// Run starts the workers and blocks until ctx is done. Then it stops
+// dequeuing and waits for the in-flight handlers to return, the handler
+// contexts are not cancelled by ctx but only after ShutdownTimeout. It
+// returns nil once all handlers returned, or ErrShutdownTimeout if they had
+// to be cancelled.
+func (c *Consumer) Run(ctx context.Context) error {
+	handlerCtx, cancelHandlers := context.WithCancel(context.Background())
+	defer cancelHandlers()
+
+	var wg sync.WaitGroup
+	for i := 0; i < c.config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.work(ctx, handlerCtx)
+		}()
+	}
+
+	<-ctx.Done()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	if c.config.ShutdownTimeout > 0 {
+		select {
+		case <-done:
+		case <-time.After(c.config.ShutdownTimeout):
+			zap.S().Warnf("consumer of queue %s: in-flight handlers did not return in %v, cancelling",
+				c.backend.Name(), c.config.ShutdownTimeout)
+			cancelHandlers()
+			<-done
+			return ErrShutdownTimeout
+		}
+	}
+	<-done
+	return nil
+}
+
+func (c *Consumer) work(ctx, handlerCtx context.Context) {
+	for ctx.Err() == nil {
+		var err error
+		if c.config.VisibilityTimeout > 0 && c.queue != nil {
+			err = c.reserveAndHandle(ctx, handlerCtx)
+		} else {
+			err = c.dequeueAndHandle(ctx, handlerCtx)
+		}
+		if err != nil && ctx.Err() == nil {
+			zap.S().Errorf("consumer of queue %s: %v", c.backend.Name(), err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(c.config.RetryInterval):
+			}
+		}
+	}
+}
+
+func (c *Consumer) dequeueAndHandle(ctx, handlerCtx context.Context) error {
+	item, err := c.dequeue(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to dequeue, err: %v", err)
+	}
+	if herr := c.handle(handlerCtx, *item); herr != nil {
+		if err := c.requeue(handlerCtx, item, herr); err != nil {
+			return fmt.Errorf("failed to requeue %s, err: %v", item.Key, err)
+		}
+	}
+	return nil
+}
+
+// dequeue dequeues from the queue, or from the backend without a queue
+func (c *Consumer) dequeue(ctx context.Context) (*Item, error) {
+	if c.queue != nil {
+		return c.queue.DequeueItem(ctx)
+	}
+	return DequeueFrom(ctx, c.backend)
+}
+
+func (c *Consumer) requeue(ctx context.Context, item *Item, err error) error {
+	if c.queue != nil {
+		return c.queue.RequeueCtx(ctx, item, err)
+	}
+	return RequeueTo(ctx, c.backend, item, err)
+}
+
+func (c *Consumer) reserveAndHandle(ctx, handlerCtx context.Context) error {
+	r, err := c.queue.Reserve(ctx, c.config.VisibilityTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to reserve, err: %v", err)
+	}
+	if herr := c.handle(handlerCtx, *r.Item()); herr != nil {
+		// the requeue and the ack are one txn, if it fails the lease is
+		// dropped and the item is redelivered
+		if err := r.Requeue(handlerCtx, herr); err != nil {
+			return fmt.Errorf("failed to requeue %s, err: %v", r.Key(), err)
+		}
+		return nil
+	}
+	if err := r.Ack(handlerCtx); err != nil {
+		return fmt.Errorf("failed to ack %s, err: %v", r.Key(), err)
+	}
+	return nil
+}
+
+// handle calls the handler with the item timeout and recovers its panic
+func (c *Consumer) handle(ctx context.Context, item Item) (err error) {
+	if c.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.Timeout)
+		defer cancel()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			zap.S().Errorf("consumer of queue %s: handler panic on %s: %v\n%s",
+				c.backend.Name(), item.Key, r, debug.Stack())
+			err = fmt.Errorf("handler panic: %v", r)
+		}
+	}()
+	return c.handler(ctx, item)
+}
@@ -5,28 +5,37 @@ package etcdqueue
 import (
 	"context"
 	"errors"
-	"fmt"
 	"strings"
+	"time"
 
 	v3 "github.com/coreos/etcd/clientv3"
-	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
 	spb "github.com/coreos/etcd/mvcc/mvccpb"
 	"go.uber.org/zap"
 )
 
 var (
-	ErrKeyExists      = errors.New("key already exists")
-	ErrWaitMismatch   = errors.New("unexpected wait result")
-	ErrTooManyClients = errors.New("too many clients")
-	ErrNoWatcher      = errors.New("no watcher channel")
-	ErrKeyNotFound    = errors.New("key not found")
+	ErrKeyExists       = errors.New("key already exists")
+	ErrWaitMismatch    = errors.New("unexpected wait result")
+	ErrTooManyClients  = errors.New("too many clients")
+	ErrNoWatcher       = errors.New("no watcher channel")
+	ErrKeyNotFound     = errors.New("key not found")
+	ErrNotReserved     = errors.New("item is no longer reserved")
+	ErrWatchClosed     = errors.New("watch channel closed")
+	ErrSessionDone     = errors.New("session is done")
+	ErrLocked          = errors.New("mutex is locked by another session")
+	ErrCompacted       = rpctypes.ErrCompacted
+	ErrConflict        = errors.New("key was modified since the given revision")
+	ErrQueueFull       = errors.New("queue is full")
+	ErrShutdownTimeout = errors.New("in-flight handlers did not return before the shutdown timeout")
+	ErrTooManyOps      = rpctypes.ErrTooManyOps
 )
 
 // deleteRevKey deletes a key by revision, returning false if key is missing
-func deleteRevKey(kv v3.KV, key string, rev int64) (bool, error) {
+func deleteRevKey(ctx context.Context, kv v3.KV, key string, rev int64) (bool, error) {
 	cmp := v3.Compare(v3.ModRevision(key), "=", rev)
 	req := v3.OpDelete(key)
-	txnresp, err := kv.Txn(context.TODO()).If(cmp).Then(req).Commit()
+	txnresp, err := kv.Txn(ctx).If(cmp).Then(req).Commit()
 	if err != nil {
 		return false, err
 	} else if !txnresp.Succeeded {
@@ -35,16 +44,52 @@ func deleteRevKey(kv v3.KV, key string, rev int64) (bool, error) {
 	return true, nil
 }
 
-func claimFirstKey(kv v3.KV, kvs []*spb.KeyValue) (*spb.KeyValue, error) {
-	for _, k := range kvs {
-		ok, err := deleteRevKey(kv, string(k.Key), k.ModRevision)
+// claimFirstKey deletes the first of kvs which is not claimed by another
+// client yet, it also returns the number of keys lost to other clients.
+func claimFirstKey(ctx context.Context, kv v3.KV, kvs []*spb.KeyValue) (*spb.KeyValue, int, error) {
+	for i, k := range kvs {
+		ok, err := deleteRevKey(ctx, kv, string(k.Key), k.ModRevision)
 		if err != nil {
-			return nil, err
+			return nil, i, err
 		} else if ok {
-			return k, nil
+			return k, i, nil
 		}
 	}
-	return nil, nil
+	return nil, len(kvs), nil
+}
+
+// claimBatchSize is the number of keys claimed per txn, each key is a nested
+// txn which also counts against the server --max-txn-ops (128 by default).
+const claimBatchSize = 64
+
+// claimKeys deletes kvs by revision with one nested txn per key, batched into
+// as few txns as possible. It returns the claimed kvs in order, the keys
+// claimed by other clients are skipped.
+func claimKeys(ctx context.Context, kv v3.KV, kvs []*spb.KeyValue) ([]*spb.KeyValue, error) {
+	var claimed []*spb.KeyValue
+	for len(kvs) > 0 {
+		batch := kvs
+		if len(batch) > claimBatchSize {
+			batch = batch[:claimBatchSize]
+		}
+		kvs = kvs[len(batch):]
+
+		ops := make([]v3.Op, 0, len(batch))
+		for _, k := range batch {
+			cmp := v3.Compare(v3.ModRevision(string(k.Key)), "=", k.ModRevision)
+			ops = append(ops, v3.OpTxn([]v3.Cmp{cmp}, []v3.Op{v3.OpDelete(string(k.Key))}, nil))
+		}
+		txnresp, err := kv.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return claimed, err
+		}
+		for i, resp := range txnresp.Responses {
+			if resp.GetResponseTxn().Succeeded {
+				claimed = append(claimed, batch[i])
+			}
+		}
+	}
+	return claimed, nil
 }
 
 // cancel watch
@@ -54,38 +99,47 @@ func (q *Queue) CancelWatch() {
 
 // Enqueue key
 func (q *Queue) EnqueueReturnKey(val string) (string, error) {
-	rkv, err := newUniqueKV(q.client, q.keyPrefix, val)
+	return q.EnqueueReturnKeyCtx(q.ctx, val)
+}
+
+// EnqueueReturnKeyCtx is EnqueueReturnKey with a context
+func (q *Queue) EnqueueReturnKeyCtx(ctx context.Context, val string) (string, error) {
+	start := time.Now()
+	key, _, err := q.putItem(ctx, val, nil, nil)
 	if err != nil {
 		return "", err
 	}
-	if rkv == nil {
-		return "", fmt.Errorf("newUniqueKV returns nil")
-	}
-	return rkv.Key(), nil
+	q.observeEnqueue(start, 1)
+	return key, nil
 }
 
 // Get key
+//
+// Deprecated: use Queue.Store, whose keys are all relative to the prefix.
 func (q *Queue) GetKey(key string) (string, error) {
-	resp, err := q.client.Get(q.ctx,
-		strings.Join([]string{q.keyPrefix, key}, "/"),
-		v3.WithLimit(1))
-	if err != nil {
-		return "", err
-	}
-	for _, k := range resp.Kvs {
-		if k == nil {
-			continue
-		}
-		zap.S().Debugf("key: %s, value: %s, create revision: %d, mod revision: %d",
-			string(k.Key), string(k.Value), k.CreateRevision, k.ModRevision)
-		return string(k.Value), nil
-	}
-	return "", ErrKeyNotFound
+	return q.GetKeyCtx(q.ctx, key)
+}
+
+// GetKeyCtx is GetKey with a context
+//
+// Deprecated: use Queue.Store, whose keys are all relative to the prefix.
+func (q *Queue) GetKeyCtx(ctx context.Context, key string) (string, error) {
+	val, _, err := q.GetKeyAndRevisionCtx(ctx, key)
+	return val, err
 }
 
 // Get key and revision
+//
+// Deprecated: use Queue.Store, whose keys are all relative to the prefix.
 func (q *Queue) GetKeyAndRevision(key string) (string, int64, error) {
-	resp, err := q.client.Get(q.ctx,
+	return q.GetKeyAndRevisionCtx(q.ctx, key)
+}
+
+// GetKeyAndRevisionCtx is GetKeyAndRevision with a context
+//
+// Deprecated: use Queue.Store, whose keys are all relative to the prefix.
+func (q *Queue) GetKeyAndRevisionCtx(ctx context.Context, key string) (string, int64, error) {
+	resp, err := q.client.Get(ctx,
 		strings.Join([]string{q.keyPrefix, key}, "/"),
 		v3.WithLimit(1))
 	if err != nil {
@@ -103,24 +157,33 @@ func (q *Queue) GetKeyAndRevision(key string) (string, int64, error) {
 }
 
 // Get all keys
+//
+// Deprecated: use Queue.Store().List, whose keys are all relative to the prefix.
 func (q *Queue) GetAllKeys() (map[string]string, error) {
+	return q.GetAllKeysCtx(q.ctx)
+}
+
+// GetAllKeysCtx is GetAllKeys with a context, it pages through the whole
+// prefix including the in-flight, dead letter and delayed keys.
+//
+// Deprecated: use Queue.Store().List, whose keys are all relative to the prefix.
+func (q *Queue) GetAllKeysCtx(ctx context.Context) (map[string]string, error) {
 	results := make(map[string]string)
-	resp, err := q.client.Get(q.ctx, q.keyPrefix+"/", v3.WithPrefix())
-	if err != nil {
-		return nil, err
-	}
-	zap.S().Debugf("etcd get %d kvs", len(resp.Kvs))
-	for _, k := range resp.Kvs {
-		if k == nil {
-			continue
+	key, end := q.keyPrefix+"/", v3.GetPrefixRangeEnd(q.keyPrefix+"/")
+	for {
+		resp, err := q.client.Get(ctx, key, v3.WithRange(end), v3.WithLimit(listPageSize))
+		if err != nil {
+			return nil, err
 		}
-		results[string(k.Key)] = string(k.Value)
-		break
-	}
-	if resp.More {
-		zap.S().Debug("resp.More is true")
+		zap.S().Debugf("etcd get %d kvs", len(resp.Kvs))
+		for _, k := range resp.Kvs {
+			results[string(k.Key)] = string(k.Value)
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return results, nil
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
 	}
-	return results, nil
 }
 
 // returns
@@ -128,13 +191,19 @@ func (q *Queue) GetAllKeys() (map[string]string, error) {
 // value string
 // error
 func (q *Queue) GetFirstKey() (string, string, error) {
-	resp, err := q.client.Get(q.ctx, q.keyPrefix, v3.WithFirstKey()...)
+	return q.GetFirstKeyCtx(q.ctx)
+}
+
+// GetFirstKeyCtx is GetFirstKey with a context, it blocks until an item is
+// available or ctx is done.
+func (q *Queue) GetFirstKeyCtx(ctx context.Context) (string, string, error) {
+	resp, err := q.getItems(ctx, v3.WithFirstKey()...)
 	if err != nil {
 		return "", "", err
 	}
 	zap.S().Debugf("GetFirstKey: %d keys in queue %s", resp.Count, q.keyPrefix)
 
-	return q.convertKey(resp)
+	return q.convertKey(ctx, resp)
 }
 
 // returns
@@ -142,53 +211,50 @@ func (q *Queue) GetFirstKey() (string, string, error) {
 // value string
 // error
 func (q *Queue) GetLastKey() (string, string, error) {
-	resp, err := q.client.Get(q.ctx, q.keyPrefix, v3.WithLastKey()...)
+	return q.GetLastKeyCtx(q.ctx)
+}
+
+// GetLastKeyCtx is GetLastKey with a context, it blocks until an item is
+// available or ctx is done.
+func (q *Queue) GetLastKeyCtx(ctx context.Context) (string, string, error) {
+	resp, err := q.getItems(ctx, v3.WithLastKey()...)
 	if err != nil {
 		return "", "", err
 	}
 	zap.S().Debugf("GetLastKey: %d keys in queue %s", resp.Count, q.keyPrefix)
 
-	return q.convertKey(resp)
+	return q.convertKey(ctx, resp)
 }
 
-func (q *Queue) convertKey(resp *v3.GetResponse) (string, string, error) {
+func (q *Queue) convertKey(ctx context.Context, resp *v3.GetResponse) (string, string, error) {
 	for _, k := range resp.Kvs {
 		if k == nil {
 			continue
 		}
 		zap.S().Debugf("key: %s, value: %s, create revision: %d, mod revision: %d",
 			string(k.Key), string(k.Value), k.CreateRevision, k.ModRevision)
-		return string(k.Key), string(k.Value), nil
+		return string(k.Key), decodeItem(k).Value, nil
 	}
 
 	if resp.More {
 		zap.S().Error("no key in resp, resp.More is true, retrying")
-		return q.GetFirstKey()
+		q.metrics.moreRetry(q.keyPrefix)
+		return q.GetFirstKeyCtx(ctx)
 	}
 
 	// nothing yet; wait on elements
-	ev, err := WaitPrefixEvents(
-		q.ctx,
-		q.client,
-		q.keyPrefix,
-		resp.Header.Revision,
-		[]mvccpb.Event_EventType{mvccpb.PUT})
+	ev, err := q.waitItemPut(ctx, resp.Header.Revision)
 	if err != nil {
 		return "", "", err
 	}
-
-	if ev == nil || ev.Kv == nil {
-		zap.S().Error("ev | ev.Kv is nil, retrying")
-		return q.GetFirstKey()
-	}
-	return string(ev.Kv.Key), string(ev.Kv.Value), nil
+	return string(ev.Kv.Key), decodeItem(ev.Kv).Value, nil
 }
 
 // returning false, nil means the key does not exist
-func updateKey(kv v3.KV, key, value string) (bool, error) {
+func updateKey(ctx context.Context, kv v3.KV, key, value string) (bool, error) {
 	cmp := v3.Compare(v3.CreateRevision(key), ">", 0)
 	req := v3.OpPut(key, value)
-	txnresp, err := kv.Txn(context.TODO()).If(cmp).Then(req).Commit()
+	txnresp, err := kv.Txn(ctx).If(cmp).Then(req).Commit()
 	if err != nil {
 		return false, err
 	} else if !txnresp.Succeeded {
@@ -198,18 +264,30 @@ func updateKey(kv v3.KV, key, value string) (bool, error) {
 }
 
 // Update Key
+//
+// Deprecated: use Queue.Store, whose keys are all relative to the prefix.
 func (q *Queue) UpdateKey(key, value string) error {
-	exist, err := updateKey(q.client, key, value)
+	return q.UpdateKeyCtx(q.ctx, key, value)
+}
+
+// UpdateKeyCtx is UpdateKey with a context
+//
+// Deprecated: use Queue.Store, whose keys are all relative to the prefix.
+func (q *Queue) UpdateKeyCtx(ctx context.Context, key, value string) error {
+	exist, err := updateKey(ctx, q.client, key, value)
+	if err != nil {
+		return err
+	}
 	if !exist {
 		return ErrKeyNotFound
 	}
-	return err
+	return nil
 }
 
-func updateRevKey(kv v3.KV, key, value string, rev int64) (bool, error) {
+func updateRevKey(ctx context.Context, kv v3.KV, key, value string, rev int64) (bool, error) {
 	cmp := v3.Compare(v3.ModRevision(key), "=", rev)
 	req := v3.OpPut(key, value)
-	txnresp, err := kv.Txn(context.TODO()).If(cmp).Then(req).Commit()
+	txnresp, err := kv.Txn(ctx).If(cmp).Then(req).Commit()
 	if err != nil {
 		return false, err
 	} else if !txnresp.Succeeded {
@@ -219,62 +297,95 @@ func updateRevKey(kv v3.KV, key, value string, rev int64) (bool, error) {
 }
 
 // Update key with revision
+//
+// Deprecated: use Queue.Store, whose keys are all relative to the prefix.
 func (q *Queue) UpdateKeyWithRevison(key, value string, revision int64) (bool, error) {
-	return updateRevKey(q.client, key, value, revision)
+	return q.UpdateKeyWithRevisionCtx(q.ctx, key, value, revision)
+}
+
+// UpdateKeyWithRevisionCtx is UpdateKeyWithRevison with a context
+//
+// Deprecated: use Queue.Store, whose keys are all relative to the prefix.
+func (q *Queue) UpdateKeyWithRevisionCtx(ctx context.Context, key, value string, revision int64) (bool, error) {
+	return updateRevKey(ctx, q.client, key, value, revision)
 }
 
 // Delete key
+//
+// Deprecated: use Queue.Store, whose keys are all relative to the prefix.
 func (q *Queue) DeleteKey(key string) error {
-	_, err := q.client.Delete(q.ctx, key)
+	return q.DeleteKeyCtx(q.ctx, key)
+}
+
+// DeleteKeyCtx is DeleteKey with a context
+//
+// Deprecated: use Queue.Store, whose keys are all relative to the prefix.
+func (q *Queue) DeleteKeyCtx(ctx context.Context, key string) error {
+	_, err := q.client.Delete(ctx, key)
 	return err
 }
 
 // Delete key with revision
+//
+// Deprecated: use Queue.Store, whose keys are all relative to the prefix.
 func (q *Queue) DeleteKeyWithRevision(key string, revision int64) (bool, error) {
-	return deleteRevKey(q.client, key, revision)
+	return q.DeleteKeyWithRevisionCtx(q.ctx, key, revision)
+}
+
+// DeleteKeyWithRevisionCtx is DeleteKeyWithRevision with a context
+//
+// Deprecated: use Queue.Store, whose keys are all relative to the prefix.
+func (q *Queue) DeleteKeyWithRevisionCtx(ctx context.Context, key string, revision int64) (bool, error) {
+	return deleteRevKey(ctx, q.client, key, revision)
 }
 
 // Dequeue first key
 func (q *Queue) DequeueFirstKey() (string, error) {
-	resp, err := q.client.Get(q.ctx, q.keyPrefix, v3.WithFirstKey()...)
+	return q.DequeueFirstKeyCtx(q.ctx)
+}
+
+// DequeueFirstKeyCtx is DequeueFirstKey with a context, it blocks until an
+// item is available or ctx is done.
+func (q *Queue) DequeueFirstKeyCtx(ctx context.Context) (string, error) {
+	start := time.Now()
+	resp, err := q.getItems(ctx, v3.WithFirstKey()...)
 	if err != nil {
 		return "", err
 	}
 
-	return q.convertDequeueKey(resp)
+	kv, err := q.convertDequeueKey(ctx, resp)
+	if err != nil {
+		return "", err
+	}
+	q.observeDequeue("dequeue", start, 1)
+	return q.claimedItem(ctx, kv).Value, nil
 }
 
-func (q *Queue) convertDequeueKey(resp *v3.GetResponse) (string, error) {
-	kv, err := claimFirstKey(q.client, resp.Kvs)
+func (q *Queue) convertDequeueKey(ctx context.Context, resp *v3.GetResponse) (*spb.KeyValue, error) {
+	kv, lost, err := claimFirstKey(ctx, q.client, resp.Kvs)
+	q.metrics.claimConflict(q.keyPrefix, lost)
 	if err != nil {
-		return "", err
+		return nil, err
 	} else if kv != nil {
-		return string(kv.Value), nil
+		return kv, nil
 	} else if resp.More {
 		// missed some items, retry to read in more
-		return q.Dequeue()
+		q.metrics.moreRetry(q.keyPrefix)
+		return q.dequeueKV(ctx)
 	}
 
 	// nothing yet; wait on elements
-	ev, err := WaitPrefixEvents(
-		q.ctx,
-		q.client,
-		q.keyPrefix,
-		resp.Header.Revision,
-		[]mvccpb.Event_EventType{mvccpb.PUT})
+	ev, err := q.waitItemPut(ctx, resp.Header.Revision)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	ok, err := deleteRevKey(q.client, string(ev.Kv.Key), ev.Kv.ModRevision)
+	ok, err := deleteRevKey(ctx, q.client, string(ev.Kv.Key), ev.Kv.ModRevision)
 	if err != nil {
-		return "", err
+		return nil, err
 	} else if !ok {
-		return q.Dequeue()
+		q.metrics.claimConflict(q.keyPrefix, 1)
+		return q.dequeueKV(ctx)
 	}
-	return string(ev.Kv.Value), err
-}
-
-func putKV(kv v3.KV, key, val string, leaseID v3.LeaseID) (int64, error) {
-	return 0, nil
+	return ev.Kv, nil
 }
@@ -0,0 +1,229 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"go.uber.org/zap"
+)
+
+const (
+	// deadLetterDir is the default dead letter prefix, <prefix>/dlq
+	deadLetterDir      = "dlq"
+	defaultMaxAttempts = 5
+
+	envelopeVersion = 1
+	// base64Encoding marks an envelope value which is not valid UTF-8, such as
+	// a protobuf or gzip value of a TypedQueue, and can not be a JSON string
+	base64Encoding = "base64"
+)
+
+// Envelope is the stored format of a requeued item, it keeps the attempt
+// count and the last error alongside the value. Items which were never
+// requeued nor enqueued by EnqueueUnique are stored as plain values.
+type Envelope struct {
+	Version   int       `json:"etcdqueueEnvelope"`
+	Value     string    `json:"value"`
+	Encoding  string    `json:"encoding,omitempty"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"lastError,omitempty"`
+	FailedAt  time.Time `json:"failedAt"`
+	// DedupKey and DedupTTL are the dedup key of an item of EnqueueUnique
+	// and the seconds it is kept after the item is dequeued or acked
+	DedupKey string `json:"dedupKey,omitempty"`
+	DedupTTL int64  `json:"dedupTTL,omitempty"`
+}
+
+// WithMaxAttempts sets the number of failed attempts after which Requeue
+// moves an item to the dead letter queue
+func WithMaxAttempts(n int) QueueOption {
+	return func(q *Queue) { q.maxAttempts = n }
+}
+
+// WithDeadLetterPrefix sets the dead letter queue prefix, <prefix>/dlq by default
+func WithDeadLetterPrefix(prefix string) QueueOption {
+	return func(q *Queue) { q.deadLetterPrefix = prefix }
+}
+
+// decodeItem converts a stored kv to an item, unwrapping the envelope if any
+func decodeItem(kv *mvccpb.KeyValue) *Item {
+	return DecodeItem(string(kv.Key), kv.Value, kv.ModRevision)
+}
+
+// DecodeItem converts a stored value to an item, unwrapping the envelope if
+// any, for the Backend implementations
+func DecodeItem(key string, value []byte, revision int64) *Item {
+	item := &Item{Key: key, Value: string(value), Revision: revision}
+	var env Envelope
+	if err := json.Unmarshal(value, &env); err == nil && env.Version == envelopeVersion {
+		item.Value = env.Value
+		if env.Encoding == base64Encoding {
+			if val, err := base64.StdEncoding.DecodeString(env.Value); err == nil {
+				item.Value = string(val)
+			}
+		}
+		item.Attempts = env.Attempts
+		item.LastError = env.LastError
+		item.dedupKey, item.dedupTTL = env.DedupKey, env.DedupTTL
+	}
+	return item
+}
+
+// Requeue puts a failed item back to the tail of the queue with its attempt
+// count increased, once the item failed MaxAttempts times it is moved to the
+// dead letter queue instead.
+func (q *Queue) Requeue(item *Item, err error) error {
+	return q.RequeueCtx(q.ctx, item, err)
+}
+
+// RequeueCtx is Requeue with a context
+func (q *Queue) RequeueCtx(ctx context.Context, item *Item, err error) error {
+	data, attempts, merr := encodeRequeue(item, err)
+	if merr != nil {
+		return merr
+	}
+
+	if attempts >= q.maxAttempts {
+		zap.S().Debugf("item %s failed %d attempts, moving to %s", item.Key, attempts, q.deadLetterPrefix)
+		_, perr := newUniqueKV(ctx, q.client, q.deadLetterPrefix, data)
+		return perr
+	}
+	_, _, perr := q.putItem(ctx, data, nil, nil)
+	return perr
+}
+
+// encodeRequeue returns the envelope of a failed item and its attempt count
+func encodeRequeue(item *Item, err error) (string, int, error) {
+	env := Envelope{
+		Version:  envelopeVersion,
+		Attempts: item.Attempts + 1,
+		FailedAt: time.Now(),
+		DedupKey: item.dedupKey,
+		DedupTTL: item.dedupTTL,
+	}
+	if err != nil {
+		env.LastError = err.Error()
+	}
+	data, merr := marshalEnvelope(env, item.Value)
+	return data, env.Attempts, merr
+}
+
+// marshalEnvelope sets the value of env, base64 encoded if it is not UTF-8
+func marshalEnvelope(env Envelope, val string) (string, error) {
+	env.Value = val
+	if !utf8.ValidString(val) {
+		env.Value = base64.StdEncoding.EncodeToString([]byte(val))
+		env.Encoding = base64Encoding
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal envelope, err: %v", err)
+	}
+	return string(data), nil
+}
+
+// ListDeadLetters returns all items in the dead letter queue, read by pages
+// of listPageSize
+func (q *Queue) ListDeadLetters(ctx context.Context) ([]*Item, error) {
+	var items []*Item
+	key, end := q.deadLetterPrefix+"/", v3.GetPrefixRangeEnd(q.deadLetterPrefix+"/")
+	for {
+		resp, err := q.client.Get(ctx, key, v3.WithRange(end), v3.WithLimit(listPageSize))
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			items = append(items, decodeItem(kv))
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return items, nil
+		}
+		key = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// checkDeadLetter returns an error if key is not under the dead letter prefix,
+// so that the items of the queue or of another prefix are never replayed
+func (q *Queue) checkDeadLetter(key string) error {
+	if !strings.HasPrefix(key, q.deadLetterPrefix+"/") {
+		return fmt.Errorf("key %s is not a dead letter of %s", key, q.deadLetterPrefix)
+	}
+	return nil
+}
+
+// GetDeadLetter returns the dead letter of the full key
+func (q *Queue) GetDeadLetter(ctx context.Context, key string) (*Item, error) {
+	if err := q.checkDeadLetter(key); err != nil {
+		return nil, err
+	}
+	resp, err := q.client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, kv := range resp.Kvs {
+		return decodeItem(kv), nil
+	}
+	return nil, ErrKeyNotFound
+}
+
+// ReplayDeadLetter moves a dead letter back to the tail of the queue with its
+// attempt count reset, an item of EnqueueUnique keeps its dedup key. It
+// returns false if the dead letter was modified or removed since it was read.
+func (q *Queue) ReplayDeadLetter(ctx context.Context, item *Item) (bool, error) {
+	if err := q.checkDeadLetter(item.Key); err != nil {
+		return false, err
+	}
+	val := item.Value
+	if item.dedupKey != "" {
+		env := Envelope{Version: envelopeVersion, DedupKey: item.dedupKey, DedupTTL: item.dedupTTL}
+		data, err := marshalEnvelope(env, item.Value)
+		if err != nil {
+			return false, err
+		}
+		val = data
+	}
+	return q.moveToQueue(ctx, item.Key, item.Revision, val)
+}
+
+// ReplayDeadLetters replays all dead letters and returns the number of replayed items
+func (q *Queue) ReplayDeadLetters(ctx context.Context) (int, error) {
+	items, err := q.ListDeadLetters(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, item := range items {
+		ok, err := q.ReplayDeadLetter(ctx, item)
+		if err != nil {
+			return n, err
+		} else if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// DeleteDeadLetter deletes a dead letter, returning false if it was modified
+// or removed since it was read
+func (q *Queue) DeleteDeadLetter(ctx context.Context, item *Item) (bool, error) {
+	if err := q.checkDeadLetter(item.Key); err != nil {
+		return false, err
+	}
+	return deleteRevKey(ctx, q.client, item.Key, item.Revision)
+}
+
+// PurgeDeadLetters deletes all dead letters and returns the number of deleted items
+func (q *Queue) PurgeDeadLetters(ctx context.Context) (int64, error) {
+	resp, err := q.client.Delete(ctx, q.deadLetterPrefix+"/", v3.WithPrefix())
+	if err != nil {
+		return 0, err
+	}
+	return resp.Deleted, nil
+}
@@ -0,0 +1,100 @@
+package etcdqueue
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"go.uber.org/zap"
+)
+
+// dedupDir holds the dedup keys of EnqueueUnique, <prefix>/dedup/<dedupKey>
+const dedupDir = "dedup"
+
+// EnqueueUnique puts a value unless another value was enqueued with the same
+// dedupKey and is still in the queue or was dequeued within ttl, so that a
+// producer can safely retry an enqueue. The dedup key is created like
+// putNewKV, only if it does not exist yet, in the same transaction as the
+// item. It has no lease while the item is queued, in flight, requeued or a
+// dead letter, and is bound to a lease of ttl once the item is dequeued or
+// its reservation acked, so the window is counted from then.
+//
+// It returns the key of the new item, or ErrKeyExists with the key of the
+// item which was enqueued first.
+func (q *Queue) EnqueueUnique(ctx context.Context, dedupKey, val string, ttl time.Duration) (string, error) {
+	seconds := int64(math.Ceil(ttl.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	start := time.Now()
+	key := q.dedupKey(dedupKey)
+	resp, err := q.client.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if len(resp.Kvs) != 0 {
+		return string(resp.Kvs[0].Value), ErrKeyExists
+	}
+
+	data, err := marshalEnvelope(Envelope{Version: envelopeVersion, DedupKey: key, DedupTTL: seconds}, val)
+	if err != nil {
+		return "", err
+	}
+	cmp := v3.Compare(v3.Version(key), "=", 0)
+	newKey, txnresp, err := q.putItem(ctx, data, []v3.Cmp{cmp}, func(newKey string) []v3.Op {
+		return []v3.Op{v3.OpPut(key, newKey)}
+	}, v3.OpGet(key))
+	if err != nil {
+		return "", err
+	}
+	if newKey != "" {
+		q.observeEnqueue(start, 1)
+		return newKey, nil
+	}
+	// enqueued by another client since the get
+	existing := ""
+	if kvs := txnresp.Responses[0].GetResponseRange().Kvs; len(kvs) != 0 {
+		existing = string(kvs[0].Value)
+	}
+	return existing, ErrKeyExists
+}
+
+// releaseDedup binds the dedup key of a dequeued or acked item to a lease of
+// its TTL, unless the key already has one. The item is already removed, so a
+// failure is only logged and leaves the dedup key until it is deleted.
+func (q *Queue) releaseDedup(ctx context.Context, item *Item) {
+	if item.dedupKey == "" {
+		return
+	}
+	lease, err := q.client.Grant(ctx, item.dedupTTL)
+	if err != nil {
+		zap.S().Errorf("failed to grant the lease of dedup key %s, err: %v", item.dedupKey, err)
+		return
+	}
+	txnresp, err := q.client.Txn(ctx).If(
+		v3.Compare(v3.Version(item.dedupKey), ">", 0),
+		v3.Compare(v3.LeaseValue(item.dedupKey), "=", 0),
+	).Then(v3.OpPut(item.dedupKey, "", v3.WithIgnoreValue(), v3.WithLease(lease.ID))).Commit()
+	if err != nil {
+		zap.S().Errorf("failed to put the lease of dedup key %s, err: %v", item.dedupKey, err)
+	}
+	if err != nil || !txnresp.Succeeded {
+		// the unused lease expires by itself if the revoke fails
+		q.client.Revoke(ctx, lease.ID)
+	}
+}
+
+// claimedItem decodes the kv of a dequeued item and starts the TTL of its
+// dedup key
+func (q *Queue) claimedItem(ctx context.Context, kv *mvccpb.KeyValue) *Item {
+	item := decodeItem(kv)
+	q.releaseDedup(ctx, item)
+	return item
+}
+
+func (q *Queue) dedupKey(dedupKey string) string {
+	return strings.Join([]string{q.keyPrefix, dedupDir, dedupKey}, "/")
+}
@@ -0,0 +1,158 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"go.uber.org/zap"
+)
+
+const (
+	// delayedDir holds the delayed items, <prefix>/delayed/<due>/<id>
+	delayedDir = "delayed"
+	// promoterDir is the election prefix of the promoters, <prefix>/promoter
+	promoterDir = "promoter"
+
+	promoteBatchSize = 100
+)
+
+// promoterSessionTTL is the TTL of the election session of RunPromoter, the
+// loss of its lease is found within a third of it
+var promoterSessionTTL = defaultSessionTTL
+
+// EnqueueAt puts a value which stays invisible to Dequeue and GetFirstKey
+// until t, when it is moved into the queue by RunPromoter.
+func (q *Queue) EnqueueAt(val string, t time.Time) error {
+	return q.EnqueueAtCtx(q.ctx, val, t)
+}
+
+// EnqueueAfter puts a value which stays invisible for d
+func (q *Queue) EnqueueAfter(val string, d time.Duration) error {
+	return q.EnqueueAtCtx(q.ctx, val, time.Now().Add(d))
+}
+
+// EnqueueAtCtx is EnqueueAt with a context
+func (q *Queue) EnqueueAtCtx(ctx context.Context, val string, t time.Time) error {
+	if !t.After(time.Now()) {
+		return q.EnqueueCtx(ctx, val)
+	}
+	_, err := newUniqueKV(ctx, q.client, q.delayedKey(formatDue(t)), val)
+	return err
+}
+
+// RunPromoter moves the delayed items into the queue when they are due, until
+// ctx is done. The promoters of a queue are elected with concurrency.Election
+// and only the leader moves items, so it is safe to run one in every worker.
+// It returns ErrSessionDone if the lease of the election is lost, such as
+// when etcd is unreachable for longer than its TTL; the caller must run it
+// again to campaign again, or the delayed items are never promoted.
+func (q *Queue) RunPromoter(ctx context.Context) error {
+	// the session outlives ctx, so that Close can still revoke its lease and
+	// the next promoter does not wait for the TTL
+	s, err := concurrency.NewSession(q.client, concurrency.WithTTL(int(promoterSessionTTL.Seconds())))
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	e := concurrency.NewElection(s, strings.Join([]string{q.keyPrefix, promoterDir}, "/"))
+	if err := e.Campaign(ctx, ""); err != nil {
+		return err
+	}
+	zap.S().Debugf("elected as promoter of queue %s", q.keyPrefix)
+
+	for {
+		next, rev, err := q.promoteDue(ctx)
+		if err != nil {
+			return err
+		}
+		if err := q.waitDelayed(ctx, s, next, rev); err != nil {
+			return err
+		}
+	}
+}
+
+// promoteDue moves the due delayed items into the queue. It returns the due
+// time of the next delayed item, zero if there is none, and the revision it
+// was read at.
+func (q *Queue) promoteDue(ctx context.Context) (time.Time, int64, error) {
+	for {
+		end := q.delayedKey(formatDue(time.Now().Add(time.Nanosecond)))
+		resp, err := q.client.Get(ctx, q.delayedKey(""),
+			v3.WithRange(end), v3.WithLimit(promoteBatchSize))
+		if err != nil {
+			return time.Time{}, 0, err
+		}
+		for _, kv := range resp.Kvs {
+			if _, err := q.moveToQueue(ctx, string(kv.Key), kv.ModRevision, string(kv.Value)); err != nil {
+				return time.Time{}, 0, err
+			}
+		}
+		if !resp.More {
+			break
+		}
+	}
+
+	resp, err := q.client.Get(ctx, q.delayedKey(""), v3.WithFirstKey()...)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return time.Time{}, resp.Header.Revision, nil
+	}
+	next, err := parseDue(strings.TrimPrefix(string(resp.Kvs[0].Key), q.delayedKey("")))
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	return next, resp.Header.Revision, nil
+}
+
+// waitDelayed waits until next or until a delayed item is put after rev
+func (q *Queue) waitDelayed(ctx context.Context, s *concurrency.Session, next time.Time, rev int64) error {
+	ctx1, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wc := q.client.Watch(ctx1, q.delayedKey(""), v3.WithPrefix(), v3.WithRev(rev+1), v3.WithFilterDelete())
+
+	var timer <-chan time.Time
+	if !next.IsZero() {
+		t := time.NewTimer(time.Until(next))
+		defer t.Stop()
+		timer = t.C
+	}
+
+	select {
+	case <-timer:
+		return nil
+	case wresp, ok := <-wc:
+		if !ok {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return ErrWatchClosed
+		}
+		return wresp.Err()
+	case <-s.Done():
+		return ErrSessionDone
+	}
+}
+
+func (q *Queue) delayedKey(due string) string {
+	return strings.Join([]string{q.keyPrefix, delayedDir, due}, "/")
+}
+
+// formatDue zero pads the due time so that delayed keys sort by due time
+func formatDue(t time.Time) string {
+	return fmt.Sprintf("%020d", t.UnixNano())
+}
+
+func parseDue(key string) (time.Time, error) {
+	var nsec int64
+	if _, err := fmt.Sscanf(key, "%020d", &nsec); err != nil {
+		return time.Time{}, fmt.Errorf("invalid delayed key %s, err: %v", key, err)
+	}
+	return time.Unix(0, nsec), nil
+}
@@ -0,0 +1,78 @@
+// Package etcdtest runs an embedded single node etcd server for tests, so
+// that the queue can be tested without a live etcd cluster.
+package etcdtest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/embed"
+	"github.com/coreos/pkg/capnslog"
+)
+
+var startTimeout = 30 * time.Second
+
+// Server is an embedded etcd server listening on a random local port
+type Server struct {
+	etcd *embed.Etcd
+	dir  string
+}
+
+// NewServer starts an embedded etcd server with its data in a temp dir
+func NewServer() (*Server, error) {
+	dir, err := ioutil.TempDir("", "etcdtest")
+	if err != nil {
+		return nil, err
+	}
+
+	capnslog.SetGlobalLogLevel(capnslog.ERROR)
+	cfg := embed.NewConfig()
+	cfg.Dir = dir
+	clientURL, _ := url.Parse("http://127.0.0.1:0")
+	peerURL, _ := url.Parse("http://127.0.0.1:0")
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(startTimeout):
+		e.Close()
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("embedded etcd is not ready in %v", startTimeout)
+	}
+	return &Server{etcd: e, dir: dir}, nil
+}
+
+// Endpoints returns the comma separated client endpoints, as EtcdConfig.Endpoints
+func (s *Server) Endpoints() string {
+	endpoints := make([]string, 0, len(s.etcd.Clients))
+	for _, l := range s.etcd.Clients {
+		endpoints = append(endpoints, "http://"+l.Addr().String())
+	}
+	return strings.Join(endpoints, ",")
+}
+
+// Client returns a new client of the server
+func (s *Server) Client() (*v3.Client, error) {
+	return v3.New(v3.Config{
+		Endpoints:   strings.Split(s.Endpoints(), ","),
+		DialTimeout: 5 * time.Second,
+	})
+}
+
+// Close stops the server and removes its data
+func (s *Server) Close() {
+	s.etcd.Close()
+	os.RemoveAll(s.dir)
+}
@@ -0,0 +1,209 @@
+package etcdqueue
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// Record is a line of Export, a key of the queue with its metadata
+type Record struct {
+	// Key is relative to the queue prefix, or to the dead letter prefix if
+	// DeadLetter is set
+	Key        string `json:"key"`
+	Value      string `json:"value"`
+	Encoding   string `json:"encoding,omitempty"`
+	DeadLetter bool   `json:"deadLetter,omitempty"`
+
+	CreateRevision int64 `json:"createRevision"`
+	ModRevision    int64 `json:"modRevision"`
+	Version        int64 `json:"version"`
+	// Lease is the lease ID of the key and TTL its remaining seconds at the
+	// export, keys which shared a lease share a new one after Import
+	Lease int64 `json:"lease,omitempty"`
+	TTL   int64 `json:"ttl,omitempty"`
+}
+
+// Export writes all keys of the queue as newline delimited JSON records,
+// including the in-flight, delayed and dead letter keys, and returns the
+// number of written records. The keys are read at one revision and written
+// in create revision order, so that Import keeps the dequeue order. Keys
+// whose lease expired and the election keys of the promoters are skipped.
+func (q *Queue) Export(ctx context.Context, w io.Writer) (int, error) {
+	resp, err := q.client.Get(ctx, q.keyPrefix+"/", v3.WithPrefix(), v3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	e := &exporter{
+		q:    q,
+		enc:  json.NewEncoder(w),
+		rev:  resp.Header.Revision,
+		ttls: make(map[int64]int64),
+	}
+	if err := e.exportPrefix(ctx, q.keyPrefix+"/", false); err != nil {
+		return e.n, err
+	}
+	err = e.exportPrefix(ctx, q.deadLetterPrefix+"/", true)
+	return e.n, err
+}
+
+// exporter writes the records of a queue at revision rev
+type exporter struct {
+	q    *Queue
+	enc  *json.Encoder
+	rev  int64
+	ttls map[int64]int64
+	n    int
+}
+
+// exportPrefix writes the keys under prefix page by page in create revision
+// order. A page may end within the keys of one txn, which share a create
+// revision, so the keys of the last create revision are read separately.
+func (e *exporter) exportPrefix(ctx context.Context, prefix string, deadLetter bool) error {
+	end := v3.GetPrefixRangeEnd(prefix)
+	var minRev int64
+	for {
+		opts := []v3.OpOption{v3.WithRange(end), v3.WithRev(e.rev),
+			v3.WithSort(v3.SortByCreateRevision, v3.SortAscend), v3.WithLimit(listPageSize)}
+		if minRev != 0 {
+			opts = append(opts, v3.WithMinCreateRev(minRev))
+		}
+		resp, err := e.q.client.Get(ctx, prefix, opts...)
+		if err != nil {
+			return err
+		}
+		kvs := resp.Kvs
+		if resp.More {
+			lastRev := kvs[len(kvs)-1].CreateRevision
+			for len(kvs) > 0 && kvs[len(kvs)-1].CreateRevision == lastRev {
+				kvs = kvs[:len(kvs)-1]
+			}
+			last, err := e.q.client.Get(ctx, prefix, v3.WithRange(end), v3.WithRev(e.rev),
+				v3.WithMinCreateRev(lastRev), v3.WithMaxCreateRev(lastRev))
+			if err != nil {
+				return err
+			}
+			kvs = append(kvs, last.Kvs...)
+			minRev = lastRev + 1
+		}
+		for _, kv := range kvs {
+			if err := e.write(ctx, prefix, kv, deadLetter); err != nil {
+				return err
+			}
+		}
+		if !resp.More {
+			return nil
+		}
+	}
+}
+
+func (e *exporter) write(ctx context.Context, prefix string, kv *mvccpb.KeyValue, deadLetter bool) error {
+	key := string(kv.Key)
+	if !deadLetter && strings.HasPrefix(key, e.q.deadLetterPrefix+"/") {
+		// exported with the dead letters
+		return nil
+	}
+	if !deadLetter && isSessionKey(strings.TrimPrefix(key, prefix)) {
+		return nil
+	}
+	rec := Record{
+		Key:            strings.TrimPrefix(key, prefix),
+		Value:          string(kv.Value),
+		DeadLetter:     deadLetter,
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Version:        kv.Version,
+		Lease:          kv.Lease,
+	}
+	if !utf8.Valid(kv.Value) {
+		rec.Value = base64.StdEncoding.EncodeToString(kv.Value)
+		rec.Encoding = base64Encoding
+	}
+	if kv.Lease != 0 {
+		ttl, ok := e.ttls[kv.Lease]
+		if !ok {
+			resp, err := e.q.client.TimeToLive(ctx, v3.LeaseID(kv.Lease))
+			if err != nil {
+				return err
+			}
+			ttl = resp.TTL
+			e.ttls[kv.Lease] = ttl
+		}
+		if ttl <= 0 {
+			return nil
+		}
+		rec.TTL = ttl
+	}
+	if err := e.enc.Encode(rec); err != nil {
+		return err
+	}
+	e.n++
+	return nil
+}
+
+// Import puts the records written by Export into the queue in their order,
+// one txn per record, and returns the number of imported records. The keys
+// are created under the prefix and the dead letter prefix of the queue, an
+// existing key fails the import. Keys with a lease are bound to a new lease
+// with the exported TTL. The election keys of the promoters, which older
+// exports include, are skipped.
+func (q *Queue) Import(ctx context.Context, r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	leases := make(map[int64]v3.LeaseID)
+	n := 0
+	for line := 1; ; line++ {
+		var rec Record
+		if err := dec.Decode(&rec); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, fmt.Errorf("invalid record %d, err: %v", line, err)
+		}
+		if !rec.DeadLetter && isSessionKey(rec.Key) {
+			continue
+		}
+
+		key := strings.Join([]string{q.keyPrefix, rec.Key}, "/")
+		if rec.DeadLetter {
+			key = strings.Join([]string{q.deadLetterPrefix, rec.Key}, "/")
+		}
+		val := rec.Value
+		if rec.Encoding == base64Encoding {
+			data, err := base64.StdEncoding.DecodeString(rec.Value)
+			if err != nil {
+				return n, fmt.Errorf("invalid value of %s, err: %v", key, err)
+			}
+			val = string(data)
+		}
+		leaseID := v3.NoLease
+		if rec.Lease != 0 {
+			id, ok := leases[rec.Lease]
+			if !ok {
+				lease, err := q.client.Grant(ctx, rec.TTL)
+				if err != nil {
+					return n, err
+				}
+				id = lease.ID
+				leases[rec.Lease] = id
+			}
+			leaseID = id
+		}
+		if _, err := putNewKV(ctx, q.client, key, val, leaseID); err != nil {
+			return n, fmt.Errorf("failed to import %s, err: %v", key, err)
+		}
+		n++
+	}
+}
+
+// isSessionKey returns whether the key relative to the queue prefix is the
+// election key of a promoter session, which is bound to the session of a
+// running worker and would block the election of the imported queue
+func isSessionKey(key string) bool {
+	return strings.HasPrefix(key, promoterDir+"/")
+}
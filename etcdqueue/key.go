@@ -32,22 +32,22 @@ type RemoteKV struct {
 	val string
 }
 
-func newKey(kv v3.KV, key string, leaseID v3.LeaseID) (*RemoteKV, error) {
-	return newKV(kv, key, "", leaseID)
+func newKey(ctx context.Context, kv v3.KV, key string, leaseID v3.LeaseID) (*RemoteKV, error) {
+	return newKV(ctx, kv, key, "", leaseID)
 }
 
-func newKV(kv v3.KV, key, val string, leaseID v3.LeaseID) (*RemoteKV, error) {
-	rev, err := putNewKV(kv, key, val, leaseID)
+func newKV(ctx context.Context, kv v3.KV, key, val string, leaseID v3.LeaseID) (*RemoteKV, error) {
+	rev, err := putNewKV(ctx, kv, key, val, leaseID)
 	if err != nil {
 		return nil, err
 	}
 	return &RemoteKV{kv, key, rev, val}, nil
 }
 
-func newUniqueKV(kv v3.KV, prefix string, val string) (*RemoteKV, error) {
+func newUniqueKV(ctx context.Context, kv v3.KV, prefix string, val string) (*RemoteKV, error) {
 	for {
 		newKey := fmt.Sprintf("%s/%v", prefix, time.Now().UnixNano())
-		rev, err := putNewKV(kv, newKey, val, v3.NoLease)
+		rev, err := putNewKV(ctx, kv, newKey, val, v3.NoLease)
 		if err == nil {
 			return &RemoteKV{kv, newKey, rev, val}, nil
 		}
@@ -59,10 +59,10 @@ func newUniqueKV(kv v3.KV, prefix string, val string) (*RemoteKV, error) {
 
 // putNewKV attempts to create the given key, only succeeding if the key did
 // not yet exist.
-func putNewKV(kv v3.KV, key, val string, leaseID v3.LeaseID) (int64, error) {
+func putNewKV(ctx context.Context, kv v3.KV, key, val string, leaseID v3.LeaseID) (int64, error) {
 	cmp := v3.Compare(v3.Version(key), "=", 0)
 	req := v3.OpPut(key, val, v3.WithLease(leaseID))
-	txnresp, err := kv.Txn(context.TODO()).If(cmp).Then(req).Commit()
+	txnresp, err := kv.Txn(ctx).If(cmp).Then(req).Commit()
 	if err != nil {
 		return 0, err
 	}
@@ -74,8 +74,8 @@ func putNewKV(kv v3.KV, key, val string, leaseID v3.LeaseID) (int64, error) {
 
 // newSequentialKV allocates a new sequential key <prefix>/nnnnn with a given
 // prefix and value. Note: a bookkeeping node __<prefix> is also allocated.
-func newSequentialKV(kv v3.KV, prefix, val string) (*RemoteKV, error) {
-	resp, err := kv.Get(context.TODO(), prefix, v3.WithLastKey()...)
+func newSequentialKV(ctx context.Context, kv v3.KV, prefix, val string) (*RemoteKV, error) {
+	resp, err := kv.Get(ctx, prefix, v3.WithLastKey()...)
 	if err != nil {
 		return nil, err
 	}
@@ -104,13 +104,13 @@ func newSequentialKV(kv v3.KV, prefix, val string) (*RemoteKV, error) {
 	reqPrefix := v3.OpPut(baseKey, "")
 	reqnewKey := v3.OpPut(newKey, val)
 
-	txn := kv.Txn(context.TODO())
+	txn := kv.Txn(ctx)
 	txnresp, err := txn.If(cmp).Then(reqPrefix, reqnewKey).Commit()
 	if err != nil {
 		return nil, err
 	}
 	if !txnresp.Succeeded {
-		return newSequentialKV(kv, prefix, val)
+		return newSequentialKV(ctx, kv, prefix, val)
 	}
 	return &RemoteKV{kv, newKey, txnresp.Header.Revision, val}, nil
 }
@@ -142,8 +142,8 @@ func (rk *RemoteKV) Put(val string) error {
 type EphemeralKV struct{ RemoteKV }
 
 // newEphemeralKV creates a new key/value pair associated with a session lease
-func newEphemeralKV(s *concurrency.Session, key, val string) (*EphemeralKV, error) {
-	k, err := newKV(s.Client(), key, val, s.Lease())
+func newEphemeralKV(ctx context.Context, s *concurrency.Session, key, val string) (*EphemeralKV, error) {
+	k, err := newKV(ctx, s.Client(), key, val, s.Lease())
 	if err != nil {
 		return nil, err
 	}
@@ -151,15 +151,15 @@ func newEphemeralKV(s *concurrency.Session, key, val string) (*EphemeralKV, erro
 }
 
 // newUniqueEphemeralKey creates a new unique valueless key associated with a session lease
-func newUniqueEphemeralKey(s *concurrency.Session, prefix string) (*EphemeralKV, error) {
-	return newUniqueEphemeralKV(s, prefix, "")
+func newUniqueEphemeralKey(ctx context.Context, s *concurrency.Session, prefix string) (*EphemeralKV, error) {
+	return newUniqueEphemeralKV(ctx, s, prefix, "")
 }
 
 // newUniqueEphemeralKV creates a new unique key/value pair associated with a session lease
-func newUniqueEphemeralKV(s *concurrency.Session, prefix, val string) (ek *EphemeralKV, err error) {
+func newUniqueEphemeralKV(ctx context.Context, s *concurrency.Session, prefix, val string) (ek *EphemeralKV, err error) {
 	for {
 		newKey := fmt.Sprintf("%s/%v", prefix, time.Now().UnixNano())
-		ek, err = newEphemeralKV(s, newKey, val)
+		ek, err = newEphemeralKV(ctx, s, newKey, val)
 		if err == nil || err != ErrKeyExists {
 			break
 		}
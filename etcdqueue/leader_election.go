@@ -0,0 +1,141 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"go.uber.org/zap"
+)
+
+// LeaderCallbacks are called by LeaderElector.Run
+type LeaderCallbacks struct {
+	// OnStartedLeading is started in a goroutine when elected, ctx is
+	// cancelled when the leadership is lost or Run returns.
+	OnStartedLeading func(ctx context.Context)
+	// OnStoppedLeading is called when Run returns, even if never elected
+	OnStoppedLeading func()
+	// OnNewLeader is called with the identity of each newly observed leader, optional
+	OnNewLeader func(identity string)
+}
+
+// LeaderElectionConfig leader election arguments
+type LeaderElectionConfig struct {
+	// Key is the election prefix shared by the candidates
+	Key string
+	// Identity is the value of the leader key, it is passed to OnNewLeader
+	Identity string
+	// TTL is how long the leadership is kept after the leader stops keeping
+	// its session alive, 60s by default
+	TTL       time.Duration
+	Callbacks LeaderCallbacks
+}
+
+// LeaderElector campaigns for leadership with concurrency.Election, like the
+// leaderelection package of client-go.
+type LeaderElector struct {
+	client      *v3.Client
+	config      LeaderElectionConfig
+	leading     int32
+	closeClient bool
+}
+
+// NewLeaderElector new a leader elector
+func NewLeaderElector(client *v3.Client, config LeaderElectionConfig) (*LeaderElector, error) {
+	if config.Key == "" {
+		return nil, fmt.Errorf("no election key specified")
+	}
+	if config.Callbacks.OnStartedLeading == nil {
+		return nil, fmt.Errorf("OnStartedLeading callback must not be nil")
+	}
+	return &LeaderElector{client: client, config: config}, nil
+}
+
+// NewEtcdLeaderElector new a leader elector with its own etcd client, closed
+// by Close
+func NewEtcdLeaderElector(etcdConfig *EtcdConfig, config LeaderElectionConfig) (*LeaderElector, error) {
+	etcdClient, err := NewETCDClient(etcdConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new etcd client, err: %v", err)
+	}
+	le, err := NewLeaderElector(etcdClient, config)
+	if err != nil {
+		etcdClient.Close()
+		return nil, err
+	}
+	le.closeClient = true
+	return le, nil
+}
+
+// IsLeader returns whether the elector currently holds the leadership
+func (le *LeaderElector) IsLeader() bool {
+	return atomic.LoadInt32(&le.leading) == 1
+}
+
+// Run campaigns until elected, calls OnStartedLeading and blocks until ctx is
+// done or the leadership is lost, then it resigns and calls OnStoppedLeading.
+// Like client-go, Run returns after losing the leadership, call it again to
+// rejoin the election.
+func (le *LeaderElector) Run(ctx context.Context) error {
+	if le.config.Callbacks.OnStoppedLeading != nil {
+		defer le.config.Callbacks.OnStoppedLeading()
+	}
+
+	s, err := newSession(le.client, le.config.TTL)
+	if err != nil {
+		return err
+	}
+	// closing the session revokes its lease and resigns at once
+	defer s.Close()
+
+	e := concurrency.NewElection(s, le.config.Key)
+	if le.config.Callbacks.OnNewLeader != nil {
+		observeCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go le.observe(observeCtx, e)
+	}
+
+	if err := e.Campaign(ctx, le.config.Identity); err != nil {
+		return err
+	}
+	zap.S().Debugf("%s elected as leader of %s", le.config.Identity, le.config.Key)
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	atomic.StoreInt32(&le.leading, 1)
+	defer atomic.StoreInt32(&le.leading, 0)
+	go le.config.Callbacks.OnStartedLeading(leaderCtx)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.Done():
+		zap.S().Warnf("%s lost the leadership of %s", le.config.Identity, le.config.Key)
+		return ErrSessionDone
+	}
+}
+
+// Close closes the etcd client of NewEtcdLeaderElector, call it after the
+// last Run returned
+func (le *LeaderElector) Close() error {
+	if le.closeClient {
+		return le.client.Close()
+	}
+	return nil
+}
+
+func (le *LeaderElector) observe(ctx context.Context, e *concurrency.Election) {
+	leader := ""
+	for resp := range e.Observe(ctx) {
+		if len(resp.Kvs) == 0 {
+			continue
+		}
+		if identity := string(resp.Kvs[0].Value); identity != leader {
+			leader = identity
+			le.config.Callbacks.OnNewLeader(identity)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package etcdqueue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	metricsNamespace = "etcdqueue"
+	// depthTimeout bounds the Stats calls of a scrape, which run concurrently
+	depthTimeout = 5 * time.Second
+)
+
+// operations are the operation labels of the latency, which Unregister deletes
+var operations = []string{"enqueue", "dequeue", "dequeue_n", "dequeue_to", "reserve"}
+
+// Metrics is a prometheus.Collector of the operations and depths of the
+// queues created with WithMetrics, labelled by key prefix. A nil *Metrics
+// records nothing. Every scrape reads the depths of all registered prefixes,
+// so Unregister the queues which are no longer used. The queues of the same
+// prefix share their series and the depth is read from the first of them.
+type Metrics struct {
+	enqueued       *prometheus.CounterVec
+	dequeued       *prometheus.CounterVec
+	claimConflicts *prometheus.CounterVec
+	moreRetries    *prometheus.CounterVec
+	watchWaits     *prometheus.CounterVec
+	expired        *prometheus.CounterVec
+	latency        *prometheus.HistogramVec
+	depth          *prometheus.Desc
+
+	mu     sync.Mutex
+	queues map[string][]*Queue
+}
+
+// NewMetrics new a metrics collector, register it with prometheus.MustRegister
+func NewMetrics() *Metrics {
+	counter := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      name,
+			Help:      help,
+		}, []string{"prefix"})
+	}
+	return &Metrics{
+		enqueued: counter("enqueued_total", "Number of enqueued items."),
+		dequeued: counter("dequeued_total", "Number of dequeued or reserved items."),
+		claimConflicts: counter("claim_conflicts_total",
+			"Number of items which were claimed by another consumer first."),
+		moreRetries: counter("more_retries_total",
+			"Number of dequeue retries because the read page was exhausted and resp.More was set."),
+		watchWaits: counter("watch_waits_total", "Number of dequeues which waited on a watch for an item."),
+		expired: counter("expired_total",
+			"Number of items enqueued with a TTL which expired before they were dequeued."),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Latency of the queue operations, including the wait for an item.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"prefix", "operation"}),
+		depth: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "depth"),
+			"Number of items in the queue by state.", []string{"prefix", "state"}, nil),
+		queues: make(map[string][]*Queue),
+	}
+}
+
+// WithMetrics records the operations of the queue in m and reports its depth,
+// a nil m records nothing
+func WithMetrics(m *Metrics) QueueOption {
+	return func(q *Queue) {
+		q.metrics = m
+		if m == nil {
+			return
+		}
+		m.mu.Lock()
+		m.queues[q.keyPrefix] = append(m.queues[q.keyPrefix], q)
+		m.mu.Unlock()
+	}
+}
+
+// Unregister stops reporting q, once the last queue of its prefix is
+// unregistered the depth and the series of the prefix are deleted. The
+// operations of q are still recorded if it is used again.
+func (m *Metrics) Unregister(q *Queue) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	queues := m.queues[q.keyPrefix]
+	for i := range queues {
+		if queues[i] == q {
+			queues = append(queues[:i], queues[i+1:]...)
+			break
+		}
+	}
+	if len(queues) != 0 {
+		m.queues[q.keyPrefix] = queues
+		return
+	}
+	delete(m.queues, q.keyPrefix)
+
+	for _, vec := range []*prometheus.CounterVec{m.enqueued, m.dequeued, m.claimConflicts,
+		m.moreRetries, m.watchWaits, m.expired} {
+		vec.DeleteLabelValues(q.keyPrefix)
+	}
+	for _, operation := range operations {
+		m.latency.DeleteLabelValues(q.keyPrefix, operation)
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	m.enqueued.Describe(ch)
+	m.dequeued.Describe(ch)
+	m.claimConflicts.Describe(ch)
+	m.moreRetries.Describe(ch)
+	m.watchWaits.Describe(ch)
+	m.expired.Describe(ch)
+	m.latency.Describe(ch)
+	ch <- m.depth
+}
+
+// Collect implements prometheus.Collector, the depths are read with Stats
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	m.enqueued.Collect(ch)
+	m.dequeued.Collect(ch)
+	m.claimConflicts.Collect(ch)
+	m.moreRetries.Collect(ch)
+	m.watchWaits.Collect(ch)
+	m.expired.Collect(ch)
+	m.latency.Collect(ch)
+
+	m.mu.Lock()
+	queues := make([]*Queue, 0, len(m.queues))
+	for _, qs := range m.queues {
+		queues = append(queues, qs[0])
+	}
+	m.mu.Unlock()
+
+	// read the depths concurrently, so a scrape takes up to depthTimeout
+	var wg sync.WaitGroup
+	for _, q := range queues {
+		wg.Add(1)
+		go func(q *Queue) {
+			defer wg.Done()
+			m.collectDepth(ch, q)
+		}(q)
+	}
+	wg.Wait()
+}
+
+func (m *Metrics) collectDepth(ch chan<- prometheus.Metric, q *Queue) {
+	ctx, cancel := context.WithTimeout(q.ctx, depthTimeout)
+	defer cancel()
+	stats, err := q.Stats(ctx)
+	if err != nil {
+		zap.S().Errorf("failed to get stats of queue %s, err: %v", q.keyPrefix, err)
+		return
+	}
+	for state, n := range map[string]int64{
+		"ready":       stats.Len,
+		"inflight":    stats.InFlight,
+		"dead_letter": stats.DeadLetters,
+		"delayed":     stats.Delayed,
+	} {
+		ch <- prometheus.MustNewConstMetric(m.depth, prometheus.GaugeValue, float64(n), q.keyPrefix, state)
+	}
+}
+
+// observeEnqueue records n enqueued items and the latency since start
+func (q *Queue) observeEnqueue(start time.Time, n int) {
+	q.metrics.enqueue(q.keyPrefix, n)
+	q.metrics.observe(q.keyPrefix, "enqueue", start)
+}
+
+// observeDequeue records n items dequeued by operation and the latency since start
+func (q *Queue) observeDequeue(operation string, start time.Time, n int) {
+	q.metrics.dequeue(q.keyPrefix, n)
+	q.metrics.observe(q.keyPrefix, operation, start)
+}
+
+func (m *Metrics) enqueue(prefix string, n int) {
+	if m != nil && n > 0 {
+		m.enqueued.WithLabelValues(prefix).Add(float64(n))
+	}
+}
+
+func (m *Metrics) dequeue(prefix string, n int) {
+	if m != nil && n > 0 {
+		m.dequeued.WithLabelValues(prefix).Add(float64(n))
+	}
+}
+
+func (m *Metrics) claimConflict(prefix string, n int) {
+	if m != nil && n > 0 {
+		m.claimConflicts.WithLabelValues(prefix).Add(float64(n))
+	}
+}
+
+func (m *Metrics) moreRetry(prefix string) {
+	if m != nil {
+		m.moreRetries.WithLabelValues(prefix).Inc()
+	}
+}
+
+func (m *Metrics) watchWait(prefix string) {
+	if m != nil {
+		m.watchWaits.WithLabelValues(prefix).Inc()
+	}
+}
+
+func (m *Metrics) expire(prefix string) {
+	if m != nil {
+		m.expired.WithLabelValues(prefix).Inc()
+	}
+}
+
+// observe records the latency of a successful operation started at start
+func (m *Metrics) observe(prefix, operation string, start time.Time) {
+	if m != nil {
+		m.latency.WithLabelValues(prefix, operation).Observe(time.Since(start).Seconds())
+	}
+}
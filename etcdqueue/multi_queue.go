@@ -0,0 +1,295 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// tenantsDir holds the queues of the tenants, <prefix>/tenants/<tenant>
+	tenantsDir = "tenants"
+	// registryDir holds a key per tenant which ever enqueued, so that the
+	// consumers find the tenants without reading their items, <prefix>/registry/<tenant>
+	registryDir = "registry"
+)
+
+// TenantConfig is the scheduling and limits of a tenant of a MultiQueue
+type TenantConfig struct {
+	// Weight is the share of the dequeues the tenant gets while other tenants
+	// have items too, 1 by default. Equal weights dequeue round-robin.
+	Weight int
+	// Rate limits the dequeues of the tenant per second with a token bucket,
+	// unlimited if zero. The bucket is per MultiQueue, so the rate is per
+	// consumer process.
+	Rate float64
+	// Burst is the size of the token bucket, 1 by default
+	Burst int
+	// MaxDepth limits the number of items of the tenant, Enqueue returns a
+	// *QueueFullError when it is reached. Unlimited if zero. The depth is read
+	// before the put, so concurrent producers may exceed it slightly.
+	MaxDepth int64
+}
+
+// MultiQueueConfig configures the tenants of a MultiQueue
+type MultiQueueConfig struct {
+	// Default applies to the tenants which are not in Tenants
+	Default TenantConfig
+	Tenants map[string]TenantConfig
+}
+
+// QueueFullError is returned by Enqueue when the tenant reached its
+// MaxDepth, it matches ErrQueueFull with errors.Is.
+type QueueFullError struct {
+	Tenant   string
+	Depth    int64
+	MaxDepth int64
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("queue of tenant %s is full, depth: %d, max depth: %d", e.Tenant, e.Depth, e.MaxDepth)
+}
+
+// Is reports whether target is ErrQueueFull
+func (e *QueueFullError) Is(target error) bool { return target == ErrQueueFull }
+
+// MultiQueue keeps a queue per tenant under one prefix and dequeues across
+// them by weight, so that a tenant with many items can not starve the others.
+type MultiQueue struct {
+	client *v3.Client
+	prefix string
+	config MultiQueueConfig
+	opts   []QueueOption
+
+	mu      sync.Mutex
+	tenants map[string]*tenant
+}
+
+// tenant is the queue and scheduling state of a tenant
+type tenant struct {
+	name       string
+	queue      *Queue
+	config     TenantConfig
+	limiter    *rate.Limiter
+	current    int
+	registered bool
+}
+
+// NewMultiQueue new a multi-tenant queue, opts configure the queues of the tenants
+func NewMultiQueue(client *v3.Client, prefix string, config MultiQueueConfig, opts ...QueueOption) *MultiQueue {
+	return &MultiQueue{
+		client:  client,
+		prefix:  prefix,
+		config:  config,
+		opts:    opts,
+		tenants: make(map[string]*tenant),
+	}
+}
+
+// NewEtcdMultiQueue new a multi-tenant queue with a new etcd client
+func NewEtcdMultiQueue(etcdConfig *EtcdConfig, prefix string, config MultiQueueConfig,
+	opts ...QueueOption) (*MultiQueue, error) {
+	etcdClient, err := NewETCDClient(etcdConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new etcd client, err: %v", err)
+	}
+	return NewMultiQueue(etcdClient, prefix, config, opts...), nil
+}
+
+// Tenant returns the queue of a tenant, such as to Requeue a dequeued item
+func (m *MultiQueue) Tenant(name string) *Queue {
+	return m.tenant(name).queue
+}
+
+// Tenants returns the names of the tenants which ever enqueued
+func (m *MultiQueue) Tenants(ctx context.Context) ([]string, error) {
+	names, _, err := m.listTenants(ctx)
+	return names, err
+}
+
+// Enqueue puts val into the queue of tenant and returns its key. It returns a
+// *QueueFullError if the tenant has MaxDepth items.
+func (m *MultiQueue) Enqueue(ctx context.Context, tenantName, val string) (string, error) {
+	if tenantName == "" || strings.Contains(tenantName, "/") {
+		return "", fmt.Errorf("invalid tenant %q", tenantName)
+	}
+	t := m.tenant(tenantName)
+	if t.config.MaxDepth > 0 {
+		depth, err := t.queue.Len(ctx)
+		if err != nil {
+			return "", err
+		}
+		if depth >= t.config.MaxDepth {
+			return "", &QueueFullError{Tenant: tenantName, Depth: depth, MaxDepth: t.config.MaxDepth}
+		}
+	}
+
+	start := time.Now()
+	m.mu.Lock()
+	registered := t.registered
+	m.mu.Unlock()
+	var ops func(string) []v3.Op
+	if !registered {
+		ops = func(string) []v3.Op { return []v3.Op{v3.OpPut(m.registryKey(tenantName), "")} }
+	}
+	newKey, _, err := t.queue.putItem(ctx, val, nil, ops)
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	t.registered = true
+	m.mu.Unlock()
+	t.queue.observeEnqueue(start, 1)
+	return newKey, nil
+}
+
+// Dequeue returns an item and its tenant. The tenants with items are picked
+// by smooth weighted round-robin, skipping the tenants without tokens. If no
+// tenant has items, Dequeue blocks until one is enqueued, a token is
+// available or ctx is done.
+func (m *MultiQueue) Dequeue(ctx context.Context) (string, *Item, error) {
+	start := time.Now()
+	for {
+		names, rev, err := m.listTenants(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+		tenants := m.schedule(names)
+		var delay time.Duration
+		for _, t := range tenants {
+			r := t.limiter.Reserve()
+			if d := r.Delay(); d > 0 {
+				r.Cancel()
+				if delay == 0 || d < delay {
+					delay = d
+				}
+				continue
+			}
+			kv, _, err := t.queue.tryDequeueKV(ctx)
+			if err != nil {
+				r.Cancel()
+				return "", nil, err
+			}
+			if kv == nil {
+				r.Cancel()
+				m.idle(t)
+				continue
+			}
+			m.picked(t, tenants)
+			t.queue.observeDequeue("dequeue", start, 1)
+			return t.name, t.queue.claimedItem(ctx, kv), nil
+		}
+
+		// nothing to dequeue; wait on a put or on the next token
+		if err := m.wait(ctx, rev, delay); err != nil {
+			return "", nil, err
+		}
+	}
+}
+
+// wait waits until a key is put under the prefix after rev, or until delay
+// passed if it is not zero
+func (m *MultiQueue) wait(ctx context.Context, rev int64, delay time.Duration) error {
+	wctx := ctx
+	if delay > 0 {
+		var cancel context.CancelFunc
+		wctx, cancel = context.WithTimeout(ctx, delay)
+		defer cancel()
+	}
+	_, err := WaitPrefixEvents(wctx, m.client, m.prefix+"/", rev+1, []mvccpb.Event_EventType{mvccpb.PUT})
+	if err != nil && ctx.Err() == nil && wctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// listTenants returns the registered tenants and the revision it read at
+func (m *MultiQueue) listTenants(ctx context.Context) ([]string, int64, error) {
+	registry := strings.Join([]string{m.prefix, registryDir}, "/") + "/"
+	resp, err := m.client.Get(ctx, registry, v3.WithPrefix(), v3.WithKeysOnly())
+	if err != nil {
+		return nil, 0, err
+	}
+	names := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		names = append(names, strings.TrimPrefix(string(kv.Key), registry))
+	}
+	return names, resp.Header.Revision, nil
+}
+
+// tenant returns the state of a tenant, creating it on first use
+func (m *MultiQueue) tenant(name string) *tenant {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tenants[name]; ok {
+		return t
+	}
+	config, ok := m.config.Tenants[name]
+	if !ok {
+		config = m.config.Default
+	}
+	if config.Weight <= 0 {
+		config.Weight = 1
+	}
+	if config.Burst <= 0 {
+		config.Burst = 1
+	}
+	limit := rate.Inf
+	if config.Rate > 0 {
+		limit = rate.Limit(config.Rate)
+	}
+	t := &tenant{
+		name:    name,
+		queue:   NewQueue(m.client, strings.Join([]string{m.prefix, tenantsDir, name}, "/"), m.opts...),
+		config:  config,
+		limiter: rate.NewLimiter(limit, config.Burst),
+	}
+	m.tenants[name] = t
+	return t
+}
+
+// schedule returns the tenants in the order to try, the one whose current
+// weight increases the most first
+func (m *MultiQueue) schedule(names []string) []*tenant {
+	tenants := make([]*tenant, 0, len(names))
+	for _, name := range names {
+		tenants = append(tenants, m.tenant(name))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sort.SliceStable(tenants, func(i, j int) bool {
+		return tenants[i].current+tenants[i].config.Weight > tenants[j].current+tenants[j].config.Weight
+	})
+	return tenants
+}
+
+// picked advances the current weights after t was dequeued from
+func (m *MultiQueue) picked(t *tenant, tenants []*tenant) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	total := 0
+	for _, other := range tenants {
+		other.current += other.config.Weight
+		total += other.config.Weight
+	}
+	t.current -= total
+}
+
+// idle resets the current weight of an empty tenant, so that it does not
+// collect a burst of turns while it has no items
+func (m *MultiQueue) idle(t *tenant) {
+	m.mu.Lock()
+	t.current = 0
+	m.mu.Unlock()
+}
+
+func (m *MultiQueue) registryKey(name string) string {
+	return strings.Join([]string{m.prefix, registryDir, name}, "/")
+}
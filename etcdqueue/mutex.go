@@ -0,0 +1,114 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+)
+
+const defaultSessionTTL = 60 * time.Second
+
+// Mutex is a distributed lock on a key prefix, held by a session lease so that
+// it is released when the holder dies.
+type Mutex struct {
+	client      *v3.Client
+	session     *concurrency.Session
+	mutex       *concurrency.Mutex
+	pfx         string
+	closeClient bool
+}
+
+// NewMutex new a mutex on key. The lock is released ttl after the holder stops
+// keeping its session alive, 60s by default.
+func NewMutex(client *v3.Client, key string, ttl time.Duration) (*Mutex, error) {
+	s, err := newSession(client, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return &Mutex{
+		client:  client,
+		session: s,
+		mutex:   concurrency.NewMutex(s, key),
+		pfx:     key + "/",
+	}, nil
+}
+
+// NewEtcdMutex new a mutex with its own etcd client, closed by Close
+func NewEtcdMutex(etcdConfig *EtcdConfig, key string, ttl time.Duration) (*Mutex, error) {
+	etcdClient, err := NewETCDClient(etcdConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new etcd client, err: %v", err)
+	}
+	m, err := NewMutex(etcdClient, key, ttl)
+	if err != nil {
+		etcdClient.Close()
+		return nil, err
+	}
+	m.closeClient = true
+	return m, nil
+}
+
+// Lock blocks until the lock is acquired or ctx is done, use a ctx with
+// timeout to bound the wait.
+func (m *Mutex) Lock(ctx context.Context) error {
+	return m.mutex.Lock(ctx)
+}
+
+// TryLock acquires the lock without waiting, it returns ErrLocked if the
+// lock is held by another session.
+func (m *Mutex) TryLock(ctx context.Context) error {
+	myKey := fmt.Sprintf("%s%x", m.pfx, m.session.Lease())
+	cmp := v3.Compare(v3.CreateRevision(myKey), "=", 0)
+	put := v3.OpPut(myKey, "", v3.WithLease(m.session.Lease()))
+	get := v3.OpGet(myKey)
+	getOwner := v3.OpGet(m.pfx, v3.WithFirstCreate()...)
+	resp, err := m.client.Txn(ctx).If(cmp).Then(put, getOwner).Else(get, getOwner).Commit()
+	if err != nil {
+		return err
+	}
+	myRev := resp.Header.Revision
+	if !resp.Succeeded {
+		myRev = resp.Responses[0].GetResponseRange().Kvs[0].CreateRevision
+	}
+	ownerKey := resp.Responses[1].GetResponseRange().Kvs
+	if len(ownerKey) != 0 && ownerKey[0].CreateRevision != myRev {
+		if _, err := m.client.Delete(ctx, myKey); err != nil {
+			return err
+		}
+		return ErrLocked
+	}
+	// we own the lock, Lock returns at once and records the key for Unlock
+	return m.mutex.Lock(ctx)
+}
+
+// Unlock releases the lock
+func (m *Mutex) Unlock(ctx context.Context) error {
+	return m.mutex.Unlock(ctx)
+}
+
+// Done is closed when the session is lost, the lock is no longer held then
+func (m *Mutex) Done() <-chan struct{} {
+	return m.session.Done()
+}
+
+// Close releases the lock if held and closes the session
+func (m *Mutex) Close() error {
+	err := m.session.Close()
+	if m.closeClient {
+		m.client.Close()
+	}
+	return err
+}
+
+// newSession new a session with ttl rounded up to seconds, 60s by default
+func newSession(client *v3.Client, ttl time.Duration) (*concurrency.Session, error) {
+	if ttl <= 0 {
+		ttl = defaultSessionTTL
+	}
+	seconds := int(math.Ceil(ttl.Seconds()))
+	return concurrency.NewSession(client, concurrency.WithTTL(seconds))
+}
@@ -0,0 +1,201 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+)
+
+// Ordering is how the keys of new items are allocated
+type Ordering int
+
+const (
+	// OrderTimestamp names items <prefix>/<unix nanos> and dequeues them by
+	// create revision. The key order depends on the clocks of the producers.
+	OrderTimestamp Ordering = iota
+	// OrderSequence names items <prefix>/<%020d counter>, the counter is
+	// increased in the same txn as the put, like newSequentialKV, so the key
+	// order is the commit order. Items are dequeued by key.
+	OrderSequence
+)
+
+const (
+	// seqDir is the counter of OrderSequence, <prefix>/seq
+	seqDir = "seq"
+	// seqKeyLen is the length of the zero padded item keys
+	seqKeyLen = 20
+)
+
+// WithOrdering sets the ordering of the queue, OrderTimestamp by default. To
+// switch a queue which holds timestamp keys to OrderSequence, restart all its
+// clients with OrderSequence and then call MigrateKeys once, the counter starts
+// after the largest timestamp so the old items stay in front.
+func WithOrdering(ordering Ordering) QueueOption {
+	return func(q *Queue) { q.ordering = ordering }
+}
+
+// orderOpts sorts the queue items in dequeue order
+func (q *Queue) orderOpts() v3.OpOption {
+	if q.ordering == OrderSequence {
+		return v3.WithSort(v3.SortByKey, v3.SortAscend)
+	}
+	return v3.WithSort(v3.SortByCreateRevision, v3.SortAscend)
+}
+
+// putItem puts val as a new item at the tail of the queue. It commits in one
+// txn with ops(newKey) if cmps hold, otherwise it returns an unsucceeded
+// response of elseOps and no key.
+func (q *Queue) putItem(ctx context.Context, val string, cmps []v3.Cmp,
+	ops func(newKey string) []v3.Op, elseOps ...v3.Op) (string, *v3.TxnResponse, error) {
+	return q.putLeasedItem(ctx, val, v3.NoLease, cmps, ops, elseOps...)
+}
+
+// putLeasedItem is putItem with the item bound to leaseID
+func (q *Queue) putLeasedItem(ctx context.Context, val string, leaseID v3.LeaseID, cmps []v3.Cmp,
+	ops func(newKey string) []v3.Op, elseOps ...v3.Op) (string, *v3.TxnResponse, error) {
+	for {
+		newKey, guards, puts, err := q.allocKey(ctx)
+		if err != nil {
+			return "", nil, err
+		}
+		puts = append(puts, v3.OpPut(newKey, val, v3.WithLease(leaseID)))
+		if ops != nil {
+			puts = append(puts, ops(newKey)...)
+		}
+		txnresp, err := q.client.Txn(ctx).If(cmps...).Then(
+			v3.OpTxn(guards, puts, nil),
+		).Else(elseOps...).Commit()
+		if err != nil {
+			return "", nil, err
+		}
+		if !txnresp.Succeeded {
+			return "", txnresp, nil
+		}
+		if txnresp.Responses[0].GetResponseTxn().Succeeded {
+			return newKey, txnresp, nil
+		}
+		// new key already exists or the counter moved, retry with another one
+	}
+}
+
+// allocKey returns a new item key with the compares and puts which allocate it
+func (q *Queue) allocKey(ctx context.Context) (string, []v3.Cmp, []v3.Op, error) {
+	keys, cmps, ops, err := q.allocKeys(ctx, 1)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return keys[0], cmps, ops, nil
+}
+
+// allocKeys returns n new item keys in order with the compares and puts which
+// allocate them
+func (q *Queue) allocKeys(ctx context.Context, n int) ([]string, []v3.Cmp, []v3.Op, error) {
+	keys := make([]string, 0, n)
+	var cmps []v3.Cmp
+	if q.ordering != OrderSequence {
+		now := time.Now().UnixNano()
+		for i := 0; i < n; i++ {
+			newKey := fmt.Sprintf("%s/%v", q.keyPrefix, now+int64(i))
+			keys = append(keys, newKey)
+			cmps = append(cmps, v3.Compare(v3.Version(newKey), "=", 0))
+		}
+		return keys, cmps, nil, nil
+	}
+
+	seqKey := strings.Join([]string{q.keyPrefix, seqDir}, "/")
+	resp, err := q.client.Get(ctx, seqKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var seq uint64
+	cmp := v3.Compare(v3.Version(seqKey), "=", 0)
+	if len(resp.Kvs) != 0 {
+		if seq, err = strconv.ParseUint(string(resp.Kvs[0].Value), 10, 64); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid counter %s, err: %v", seqKey, err)
+		}
+		cmp = v3.Compare(v3.ModRevision(seqKey), "=", resp.Kvs[0].ModRevision)
+	} else if seq, err = q.lastItemSeq(ctx); err != nil {
+		return nil, nil, nil, err
+	}
+	cmps = append(cmps, cmp)
+	for i := 0; i < n; i++ {
+		seq++
+		newKey := fmt.Sprintf("%s/%0*d", q.keyPrefix, seqKeyLen, seq)
+		keys = append(keys, newKey)
+		cmps = append(cmps, v3.Compare(v3.Version(newKey), "=", 0))
+	}
+	return keys, cmps, []v3.Op{v3.OpPut(seqKey, strconv.FormatUint(seq, 10))}, nil
+}
+
+// lastItemSeq returns the largest number of the item keys, the counter
+// starts after it
+func (q *Queue) lastItemSeq(ctx context.Context) (uint64, error) {
+	resp, err := q.getItems(ctx, v3.WithSort(v3.SortByKey, v3.SortDescend), v3.WithLimit(1))
+	if err != nil || len(resp.Kvs) == 0 {
+		return 0, err
+	}
+	seq, err := strconv.ParseUint(path.Base(string(resp.Kvs[0].Key)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid item key %s, err: %v", resp.Kvs[0].Key, err)
+	}
+	return seq, nil
+}
+
+// MigrateKeys zero pads the item keys which are shorter than the OrderSequence
+// keys, such as the timestamp keys, so that all keys sort by their number. The
+// renamed items keep their lease. It returns the number of renamed items.
+//
+// Until it returns, the items enqueued with OrderSequence are dequeued before
+// the older timestamp keys, as the zero padded 20 digit keys sort before the
+// 19 digit ones. To keep the order, pause the consumers while the producers
+// switch to OrderSequence and MigrateKeys runs.
+func (q *Queue) MigrateKeys(ctx context.Context) (int, error) {
+	n := 0
+	cursor := ""
+	for {
+		items, next, err := q.List(ctx, cursor, listPageSize)
+		if err != nil {
+			return n, err
+		}
+		for _, item := range items {
+			id := path.Base(item.Key)
+			if len(id) >= seqKeyLen {
+				continue
+			}
+			num, err := strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				return n, fmt.Errorf("invalid item key %s, err: %v", item.Key, err)
+			}
+			newKey := fmt.Sprintf("%s/%0*d", q.keyPrefix, seqKeyLen, num)
+			resp, err := q.client.Get(ctx, item.Key)
+			if err != nil {
+				return n, err
+			} else if len(resp.Kvs) == 0 {
+				continue
+			}
+			kv := resp.Kvs[0]
+			cmps := []v3.Cmp{
+				v3.Compare(v3.ModRevision(item.Key), "=", kv.ModRevision),
+				v3.Compare(v3.Version(newKey), "=", 0),
+			}
+			txnresp, err := q.client.Txn(ctx).If(cmps...).Then(
+				v3.OpDelete(item.Key),
+				v3.OpPut(newKey, string(kv.Value), v3.WithLease(v3.LeaseID(kv.Lease))),
+			).Commit()
+			if err != nil {
+				return n, err
+			} else if txnresp.Succeeded {
+				n++
+			}
+		}
+		if next == "" {
+			return n, nil
+		}
+		cursor = next
+	}
+}
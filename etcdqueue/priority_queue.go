@@ -0,0 +1,99 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// PriorityQueue implements a multi-reader, multi-writer distributed queue
+// which dequeues the highest priority item first.
+type PriorityQueue struct {
+	client *v3.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	keyPrefix string
+}
+
+// NewPriorityQueue create PriorityQueue
+func NewPriorityQueue(client *v3.Client, keyPrefix string) *PriorityQueue {
+	ctx1, cancel := context.WithCancel(context.Background())
+	return &PriorityQueue{client, ctx1, cancel, keyPrefix}
+}
+
+// NewEtcdPriorityQueue new a etcd priority queue
+func NewEtcdPriorityQueue(etcdConfig *EtcdConfig, keyPrefix string) (*PriorityQueue, error) {
+	etcdClient, err := NewETCDClient(etcdConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new etcd client, err: %v", err)
+	}
+	return NewPriorityQueue(etcdClient, keyPrefix), nil
+}
+
+// cancel watch
+func (q *PriorityQueue) CancelWatch() {
+	q.cancel()
+}
+
+// Enqueue puts a value into the queue with the given priority, a larger
+// value means a higher priority. Items are stored as <prefix>/<pr>/<seq>,
+// where <pr> is the inverted priority so that the first key is the highest
+// priority, and <seq> keeps FIFO order within the same priority.
+func (q *PriorityQueue) Enqueue(val string, priority uint16) error {
+	return q.EnqueueCtx(q.ctx, val, priority)
+}
+
+// EnqueueCtx is Enqueue with a context
+func (q *PriorityQueue) EnqueueCtx(ctx context.Context, val string, priority uint16) error {
+	prefix := fmt.Sprintf("%s/%05d", q.keyPrefix, math.MaxUint16-int(priority))
+	_, err := newSequentialKV(ctx, q.client, prefix, val)
+	return err
+}
+
+// Dequeue returns the highest priority item, in FIFO order within the same
+// priority. If the queue is empty, Dequeue blocks until items are available.
+func (q *PriorityQueue) Dequeue() (string, error) {
+	return q.DequeueCtx(q.ctx)
+}
+
+// DequeueCtx is Dequeue with a context. If the queue is empty, DequeueCtx
+// blocks until items are available or ctx is done.
+func (q *PriorityQueue) DequeueCtx(ctx context.Context) (string, error) {
+	resp, err := q.client.Get(ctx, q.keyPrefix+"/", v3.WithFirstKey()...)
+	if err != nil {
+		return "", err
+	}
+
+	kv, _, err := claimFirstKey(ctx, q.client, resp.Kvs)
+	if err != nil {
+		return "", err
+	} else if kv != nil {
+		return string(kv.Value), nil
+	} else if resp.More {
+		// missed some items, retry to read in more
+		return q.DequeueCtx(ctx)
+	}
+
+	// nothing yet; wait on elements
+	ev, err := WaitPrefixEvents(
+		ctx,
+		q.client,
+		q.keyPrefix+"/",
+		resp.Header.Revision,
+		[]mvccpb.Event_EventType{mvccpb.PUT})
+	if err != nil {
+		return "", err
+	}
+
+	ok, err := deleteRevKey(ctx, q.client, string(ev.Kv.Key), ev.Kv.ModRevision)
+	if err != nil {
+		return "", err
+	} else if !ok {
+		return q.DequeueCtx(ctx)
+	}
+	return string(ev.Kv.Value), err
+}
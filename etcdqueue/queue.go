@@ -16,8 +16,11 @@ package etcdqueue
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 )
 
 // Queue implements a multi-reader, multi-writer distributed queue.
@@ -27,28 +30,246 @@ type Queue struct {
 	cancel context.CancelFunc
 
 	keyPrefix string
+
+	maxAttempts      int
+	deadLetterPrefix string
+
+	ordering Ordering
+	metrics  *Metrics
 }
 
+// QueueOption configures a Queue
+type QueueOption func(*Queue)
+
 // NewQueue create Queue
-func NewQueue(client *v3.Client, keyPrefix string) *Queue {
+func NewQueue(client *v3.Client, keyPrefix string, opts ...QueueOption) *Queue {
 	ctx1, cancel := context.WithCancel(context.Background())
-	return &Queue{client, ctx1, cancel, keyPrefix}
+	q := &Queue{
+		client:           client,
+		ctx:              ctx1,
+		cancel:           cancel,
+		keyPrefix:        keyPrefix,
+		maxAttempts:      defaultMaxAttempts,
+		deadLetterPrefix: keyPrefix + "/" + deadLetterDir,
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	return q
+}
+
+// Item is a queue element along with its retry bookkeeping
+type Item struct {
+	Key       string
+	Value     string
+	Attempts  int
+	LastError string
+	Revision  int64
+
+	// the dedup key of EnqueueUnique and its TTL in seconds
+	dedupKey string
+	dedupTTL int64
 }
 
 // enqueue
 func (q *Queue) Enqueue(val string) error {
-	_, err := newUniqueKV(q.client, q.keyPrefix, val)
-	return err
+	return q.EnqueueCtx(q.ctx, val)
+}
+
+// EnqueueCtx is Enqueue with a context
+func (q *Queue) EnqueueCtx(ctx context.Context, val string) error {
+	start := time.Now()
+	if _, _, err := q.putItem(ctx, val, nil, nil); err != nil {
+		return err
+	}
+	q.observeEnqueue(start, 1)
+	return nil
 }
 
 // Dequeue returns Enqueue()'d elements in FIFO order. If the
 // queue is empty, Dequeue blocks until elements are available.
 func (q *Queue) Dequeue() (string, error) {
-	// TODO: fewer round trips by fetching more than one key
-	resp, err := q.client.Get(q.ctx, q.keyPrefix, v3.WithFirstRev()...)
+	return q.DequeueCtx(q.ctx)
+}
+
+// DequeueCtx is Dequeue with a context. If the queue is empty, DequeueCtx
+// blocks until elements are available or ctx is done, in which case the
+// ctx error is returned.
+func (q *Queue) DequeueCtx(ctx context.Context) (string, error) {
+	item, err := q.DequeueItem(ctx)
 	if err != nil {
 		return "", err
 	}
+	return item.Value, nil
+}
+
+// DequeueItem is DequeueCtx returning the item with its key and retry
+// bookkeeping, so that a failed item can be passed to Requeue.
+func (q *Queue) DequeueItem(ctx context.Context) (*Item, error) {
+	start := time.Now()
+	kv, err := q.dequeueKV(ctx)
+	if err != nil {
+		return nil, err
+	}
+	q.observeDequeue("dequeue", start, 1)
+	return q.claimedItem(ctx, kv), nil
+}
+
+func (q *Queue) dequeueKV(ctx context.Context) (*mvccpb.KeyValue, error) {
+	resp, err := q.getItems(ctx, q.orderOpts(), v3.WithLimit(1))
+	if err != nil {
+		return nil, err
+	}
+
+	return q.convertDequeueKey(ctx, resp)
+}
+
+// tryDequeueKV claims the first item without waiting, it returns a nil kv
+// and the revision it read at if the queue is empty.
+func (q *Queue) tryDequeueKV(ctx context.Context) (*mvccpb.KeyValue, int64, error) {
+	for {
+		resp, err := q.getItems(ctx, q.orderOpts(), v3.WithLimit(1))
+		if err != nil {
+			return nil, 0, err
+		}
+		kv, lost, err := claimFirstKey(ctx, q.client, resp.Kvs)
+		q.metrics.claimConflict(q.keyPrefix, lost)
+		if err != nil {
+			return nil, 0, err
+		}
+		if kv != nil || (len(resp.Kvs) == 0 && !resp.More) {
+			return kv, resp.Header.Revision, nil
+		}
+		// lost the item to another client, read the next one
+	}
+}
+
+// DequeueN returns up to n Enqueue()'d elements in FIFO order. It reads a page
+// of n keys with one Get and claims them with as few txns as possible, so the
+// result may be shorter than n if other clients claimed some of the keys. If
+// the queue is empty, DequeueN blocks until elements are available or ctx is
+// done. The claimed elements are returned along with an error if a later txn
+// of the same page fails.
+func (q *Queue) DequeueN(ctx context.Context, n int) ([]string, error) {
+	items, err := q.dequeueItems(ctx, n)
+	vals := make([]string, 0, len(items))
+	for _, item := range items {
+		vals = append(vals, item.Value)
+	}
+	return vals, err
+}
+
+// dequeueItems is DequeueN returning the items
+func (q *Queue) dequeueItems(ctx context.Context, n int) ([]*Item, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	start := time.Now()
+	for {
+		resp, err := q.getItems(ctx, q.orderOpts(), v3.WithLimit(int64(n)))
+		if err != nil {
+			return nil, err
+		}
+
+		kvs, err := claimKeys(ctx, q.client, resp.Kvs)
+		items := make([]*Item, 0, len(kvs))
+		for _, kv := range kvs {
+			items = append(items, q.claimedItem(ctx, kv))
+		}
+		if err == nil {
+			q.metrics.claimConflict(q.keyPrefix, len(resp.Kvs)-len(kvs))
+		}
+		if err != nil || len(items) != 0 {
+			q.observeDequeue("dequeue_n", start, len(items))
+			return items, err
+		}
+		if len(resp.Kvs) != 0 || resp.More {
+			// lost all items to other clients, retry to read in more
+			if resp.More {
+				q.metrics.moreRetry(q.keyPrefix)
+			}
+			continue
+		}
+
+		// nothing yet; wait on elements
+		if _, err := q.waitItemPut(ctx, resp.Header.Revision); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// itemRange returns the key range [start, end) that holds the queue items.
+// Items are stored as <prefix>/<number>, so sub prefixes such as
+// <prefix>/inflight sort after the range and are never seen by Dequeue.
+func (q *Queue) itemRange() (string, string) {
+	return q.keyPrefix + "/", q.keyPrefix + "/:"
+}
+
+// getItems gets the queue items, opts are applied before the item range
+func (q *Queue) getItems(ctx context.Context, opts ...v3.OpOption) (*v3.GetResponse, error) {
+	start, end := q.itemRange()
+	return q.client.Get(ctx, start, append(opts, v3.WithRange(end))...)
+}
+
+// moveToQueue atomically moves key to a new item at the tail of the queue with
+// val, it returns false if key was modified or removed since rev.
+func (q *Queue) moveToQueue(ctx context.Context, key string, rev int64, val string) (bool, error) {
+	cmp := v3.Compare(v3.ModRevision(key), "=", rev)
+	newKey, _, err := q.putItem(ctx, val, []v3.Cmp{cmp}, func(string) []v3.Op {
+		return []v3.Op{v3.OpDelete(key)}
+	})
+	if err != nil {
+		return false, err
+	}
+	return newKey != "", nil
+}
+
+// Purge deletes all items and returns the number of deleted items, the
+// in-flight, dead letter and delayed items are kept
+func (q *Queue) Purge(ctx context.Context) (int64, error) {
+	start, end := q.itemRange()
+	resp, err := q.client.Delete(ctx, start, v3.WithRange(end))
+	if err != nil {
+		return 0, err
+	}
+	return resp.Deleted, nil
+}
+
+// MoveTo moves up to n items in Dequeue order to the tail of dst, all items if
+// n is zero, and returns the number of moved items. Each item is moved
+// atomically, items dequeued by other clients meanwhile are skipped.
+func (q *Queue) MoveTo(ctx context.Context, dst *Queue, n int) (int, error) {
+	if dst.keyPrefix == q.keyPrefix {
+		return 0, fmt.Errorf("can not move queue %s to itself", q.keyPrefix)
+	}
+	moved := 0
+	for n == 0 || moved < n {
+		limit := listPageSize
+		if n != 0 && n-moved < limit {
+			limit = n - moved
+		}
+		resp, err := q.getItems(ctx, q.orderOpts(), v3.WithLimit(int64(limit)))
+		if err != nil {
+			return moved, err
+		}
+		if len(resp.Kvs) == 0 {
+			break
+		}
+		for _, kv := range resp.Kvs {
+			ok, err := dst.moveToQueue(ctx, string(kv.Key), kv.ModRevision, string(kv.Value))
+			if err != nil {
+				return moved, err
+			} else if ok {
+				moved++
+			}
+		}
+	}
+	return moved, nil
+}
 
-	return q.convertDequeueKey(resp)
+// waitItemPut waits until an item is put into the queue after rev
+func (q *Queue) waitItemPut(ctx context.Context, rev int64) (*v3.Event, error) {
+	q.metrics.watchWait(q.keyPrefix)
+	start, end := q.itemRange()
+	return WaitRangeEvents(ctx, q.client, start, end, rev, []mvccpb.Event_EventType{mvccpb.PUT})
 }
@@ -1,26 +1,58 @@
 package etcdqueue
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/spf13/pflag"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/huweihuang/golib/etcdqueue/etcdtest"
 )
 
 var (
-	jobQueue *Queue
+	jobQueue   *Queue
+	testServer *etcdtest.Server
 )
 
-func TestSetup(t *testing.T) {
+func TestMain(m *testing.M) {
 	var err error
-	etcdConfig := &EtcdConfig{
-		Endpoints: "https://127.0.0.1:2379",
-		CaFile:    "/etc/kubernetes/pki/etcd/ca.crt",
-		KeyFile:   "/etc/kubernetes/pki/apiserver-etcd-client.key",
-		CertFile:  "/etc/kubernetes/pki/apiserver-etcd-client.crt",
+	testServer, err = etcdtest.NewServer()
+	if err != nil {
+		fmt.Printf("failed to start embedded etcd, error: %v\n", err)
+		os.Exit(1)
 	}
+	code := m.Run()
+	testServer.Close()
+	os.Exit(code)
+}
+
+func TestSetup(t *testing.T) {
+	jobQueue = newTestQueue(t, "/keyprefix")
+}
 
-	jobQueue, err = NewEtcdQueue(etcdConfig, "/keyprefix")
+func testEtcdConfig() *EtcdConfig {
+	return &EtcdConfig{Endpoints: testServer.Endpoints()}
+}
+
+func newTestQueue(tb testing.TB, keyPrefix string, opts ...QueueOption) *Queue {
+	queue, err := NewEtcdQueue(testEtcdConfig(), keyPrefix, opts...)
 	if err != nil {
-		t.Errorf("faied to new etcd queue, error: %v", err)
+		tb.Fatalf("failed to new etcd queue, error: %v", err)
 	}
+	return queue
 }
 
 func TestQueue_Enqueue(t *testing.T) {
@@ -42,3 +74,1760 @@ func TestQueue_Dequeue(t *testing.T) {
 		t.Logf("dequeue succeed, queue: %v", job)
 	}
 }
+
+func TestQueue_FIFO(t *testing.T) {
+	queue := newTestQueue(t, "/fifokeyprefix")
+	for i := 0; i < 5; i++ {
+		if err := queue.Enqueue(fmt.Sprintf("{job%d}", i)); err != nil {
+			t.Fatalf("failed to enqueue, error: %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		job, err := queue.Dequeue()
+		if err != nil {
+			t.Fatalf("failed to dequeue, error: %v", err)
+		}
+		if want := fmt.Sprintf("{job%d}", i); job != want {
+			t.Errorf("dequeue got %s, want %s", job, want)
+		}
+	}
+}
+
+func TestQueue_DequeueBlocks(t *testing.T) {
+	queue := newTestQueue(t, "/blockkeyprefix")
+	jobs := make(chan string)
+	go func() {
+		job, err := queue.Dequeue()
+		if err != nil {
+			t.Errorf("failed to dequeue, error: %v", err)
+		}
+		jobs <- job
+	}()
+
+	select {
+	case job := <-jobs:
+		t.Fatalf("dequeue returned %s from an empty queue", job)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if err := queue.Enqueue("{blockedjob}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	select {
+	case job := <-jobs:
+		if job != "{blockedjob}" {
+			t.Errorf("dequeue got %s", job)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("dequeue is still blocked after enqueue")
+	}
+}
+
+func TestQueue_UpdateKeyWithRevison(t *testing.T) {
+	queue := newTestQueue(t, "/caskeyprefix")
+	key, err := queue.EnqueueReturnKey("{casjob}")
+	if err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	_, rev, err := queue.GetKeyAndRevision(path.Base(key))
+	if err != nil {
+		t.Fatalf("failed to get key, error: %v", err)
+	}
+
+	ok, err := queue.UpdateKeyWithRevison(key, "{updated}", rev)
+	if err != nil || !ok {
+		t.Fatalf("failed to update key with current revision, ok: %v, error: %v", ok, err)
+	}
+	ok, err = queue.UpdateKeyWithRevison(key, "{stale}", rev)
+	if err != nil || ok {
+		t.Errorf("update key with stale revision, ok: %v, error: %v", ok, err)
+	}
+	ok, err = queue.DeleteKeyWithRevision(key, rev)
+	if err != nil || ok {
+		t.Errorf("delete key with stale revision, ok: %v, error: %v", ok, err)
+	}
+	job, err := queue.GetKey(path.Base(key))
+	if err != nil || job != "{updated}" {
+		t.Errorf("get key got %s, error: %v", job, err)
+	}
+}
+
+func TestQueue_Reserve(t *testing.T) {
+	TestSetup(t)
+	err := jobQueue.Enqueue("{reservejob}")
+	if err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	r, err := jobQueue.Reserve(context.Background(), 10*time.Second)
+	if err != nil {
+		t.Fatalf("failed to reserve, error: %v", err)
+	}
+	err = r.Ack(context.Background())
+	if err != nil {
+		t.Errorf("failed to ack, error: %v", err)
+	} else {
+		t.Logf("reserve succeed, queue: %v", r.Value())
+	}
+}
+
+func TestQueue_ReserveNack(t *testing.T) {
+	queue := newTestQueue(t, "/reservenackkeyprefix")
+	ctx := context.Background()
+	if err := queue.Enqueue("{nackjob}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	r, err := queue.Reserve(ctx, 10*time.Second)
+	if err != nil {
+		t.Fatalf("failed to reserve, error: %v", err)
+	}
+	if err := r.Nack(ctx); err != nil {
+		t.Fatalf("failed to nack, error: %v", err)
+	}
+	if err := r.Ack(ctx); err != ErrNotReserved {
+		t.Errorf("ack after nack got %v, want ErrNotReserved", err)
+	}
+	r2, err := queue.Reserve(ctx, 10*time.Second)
+	if err != nil {
+		t.Fatalf("failed to reserve, error: %v", err)
+	}
+	defer r2.Ack(ctx)
+	if r2.Value() != "{nackjob}" || r2.Item().Key != r.Item().Key {
+		t.Errorf("reserve after nack got %+v, want %+v", r2.Item(), r.Item())
+	}
+}
+
+// an item whose reservation lost its session is redelivered by Redeliver
+func TestQueue_Redeliver(t *testing.T) {
+	queue := newTestQueue(t, "/redeliverkeyprefix")
+	ctx := context.Background()
+	if err := queue.Enqueue("{redeliverjob}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	r, err := queue.Reserve(ctx, 10*time.Second)
+	if err != nil {
+		t.Fatalf("failed to reserve, error: %v", err)
+	}
+	if n, err := queue.Redeliver(ctx); err != nil || n != 0 {
+		t.Errorf("redeliver of a live reservation got %d, error: %v", n, err)
+	}
+	// the worker dies, its lease is revoked
+	r.session.Close()
+	if n, err := queue.Redeliver(ctx); err != nil || n != 1 {
+		t.Fatalf("redeliver got %d, error: %v, want 1", n, err)
+	}
+	if err := r.Ack(ctx); err != ErrNotReserved {
+		t.Errorf("ack after redelivery got %v, want ErrNotReserved", err)
+	}
+	item, err := queue.DequeueItem(ctx)
+	if err != nil {
+		t.Fatalf("failed to dequeue, error: %v", err)
+	}
+	if item.Value != "{redeliverjob}" || item.Key != r.Item().Key {
+		t.Errorf("dequeue after redelivery got %+v, want %+v", item, r.Item())
+	}
+}
+
+func TestQueue_RunRedelivery(t *testing.T) {
+	queue := newTestQueue(t, "/runredeliverykeyprefix")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	redelivery := make(chan error, 1)
+	go func() { redelivery <- queue.RunRedelivery(ctx) }()
+
+	if err := queue.Enqueue("{redeliverjob}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	r, err := queue.Reserve(ctx, 10*time.Second)
+	if err != nil {
+		t.Fatalf("failed to reserve, error: %v", err)
+	}
+	r.session.Close()
+	job, err := queue.DequeueCtx(ctx)
+	if err != nil {
+		t.Fatalf("failed to dequeue the redelivered item, error: %v", err)
+	}
+	if job != "{redeliverjob}" {
+		t.Errorf("dequeue got %s, want {redeliverjob}", job)
+	}
+	cancel()
+	if err := <-redelivery; err != context.Canceled {
+		t.Errorf("redelivery got %v, want Canceled", err)
+	}
+}
+
+// Reserve waits for a client which holds the lease key of the first item
+func TestQueue_ReserveWaitsClaim(t *testing.T) {
+	queue := newTestQueue(t, "/reserveclaimkeyprefix")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := queue.Enqueue("{claimedjob}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	items, err := queue.Peek(ctx, 1)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("failed to peek, got %v, error: %v", items, err)
+	}
+	leaseKey := queue.leaseKey(path.Base(items[0].Key))
+	if _, err := queue.client.Put(ctx, leaseKey, ""); err != nil {
+		t.Fatalf("failed to put the lease key, error: %v", err)
+	}
+
+	reserved := make(chan *Reservation, 1)
+	go func() {
+		r, err := queue.Reserve(ctx, 10*time.Second)
+		if err != nil {
+			t.Errorf("failed to reserve, error: %v", err)
+		}
+		reserved <- r
+	}()
+	select {
+	case r := <-reserved:
+		t.Fatalf("reserved %+v while another client claims it", r)
+	case <-time.After(200 * time.Millisecond):
+	}
+	// the other client gives up its claim
+	if _, err := queue.client.Delete(ctx, leaseKey); err != nil {
+		t.Fatalf("failed to delete the lease key, error: %v", err)
+	}
+	r := <-reserved
+	if r == nil || r.Value() != "{claimedjob}" {
+		t.Fatalf("reserve got %v, want {claimedjob}", r)
+	}
+	if err := r.Ack(ctx); err != nil {
+		t.Errorf("failed to ack, error: %v", err)
+	}
+}
+
+func TestPriorityQueue(t *testing.T) {
+	pq, err := NewEtcdPriorityQueue(testEtcdConfig(), "/prioritykeyprefix")
+	if err != nil {
+		t.Fatalf("failed to new etcd priority queue, error: %v", err)
+	}
+
+	for _, item := range []struct {
+		val      string
+		priority uint16
+	}{{"low1", 1}, {"high1", 10}, {"low2", 1}, {"high2", 10}} {
+		if err := pq.Enqueue(item.val, item.priority); err != nil {
+			t.Fatalf("failed to enqueue, error: %v", err)
+		}
+	}
+	for _, want := range []string{"high1", "high2", "low1", "low2"} {
+		job, err := pq.Dequeue()
+		if err != nil {
+			t.Fatalf("failed to dequeue, error: %v", err)
+		}
+		if job != want {
+			t.Errorf("dequeue got %s, want %s", job, want)
+		}
+	}
+}
+
+func TestQueue_DequeueCtx(t *testing.T) {
+	queue := newTestQueue(t, "/dequeuectxkeyprefix")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	job, err := queue.DequeueCtx(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("dequeue of empty queue got %q, error: %v, want DeadlineExceeded", job, err)
+	}
+}
+
+func TestWaitEventsCtx(t *testing.T) {
+	queue := newTestQueue(t, "/waiteventskeyprefix")
+	key := path.Join(queue.keyPrefix, "watched")
+	resp, err := queue.client.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("failed to get, error: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	evs := []mvccpb.Event_EventType{mvccpb.PUT}
+	if _, err := WaitEventsCtx(ctx, queue.client, key, resp.Header.Revision+1, evs); err != context.DeadlineExceeded {
+		t.Errorf("wait without events got %v, want DeadlineExceeded", err)
+	}
+
+	if _, err := queue.client.Put(context.Background(), key, "v"); err != nil {
+		t.Fatalf("failed to put, error: %v", err)
+	}
+	ev, err := WaitEventsCtx(context.Background(), queue.client, key, resp.Header.Revision+1, evs)
+	if err != nil || string(ev.Kv.Value) != "v" {
+		t.Errorf("wait got %v, error: %v", ev, err)
+	}
+}
+
+func TestQueue_DequeueN(t *testing.T) {
+	queue := newTestQueue(t, "/dequeuenkeyprefix")
+	for i := 0; i < 3; i++ {
+		if err := queue.Enqueue(fmt.Sprintf("{job%d}", i)); err != nil {
+			t.Fatalf("failed to enqueue, error: %v", err)
+		}
+	}
+	jobs, err := queue.DequeueN(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("failed to dequeue, error: %v", err)
+	}
+	if len(jobs) != 3 || jobs[0] != "{job0}" || jobs[2] != "{job2}" {
+		t.Errorf("dequeue got %v", jobs)
+	}
+}
+
+const benchmarkBatch = 1000
+
+// benchmarkDrain enqueues benchmarkBatch items per iteration and drains them with dequeue
+func benchmarkDrain(b *testing.B, keyPrefix string, dequeue func(q *Queue, n int) (int, error)) {
+	queue := newTestQueue(b, keyPrefix)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for j := 0; j < benchmarkBatch; j++ {
+			if err := queue.Enqueue(fmt.Sprintf("{job%d}", j)); err != nil {
+				b.Fatalf("failed to enqueue, error: %v", err)
+			}
+		}
+		b.StartTimer()
+		for n := benchmarkBatch; n > 0; {
+			got, err := dequeue(queue, n)
+			if err != nil {
+				b.Fatalf("failed to dequeue, error: %v", err)
+			}
+			n -= got
+		}
+	}
+}
+
+func BenchmarkQueue_Dequeue(b *testing.B) {
+	benchmarkDrain(b, "/benchdequeue", func(q *Queue, n int) (int, error) {
+		for i := 0; i < n; i++ {
+			if _, err := q.Dequeue(); err != nil {
+				return i, err
+			}
+		}
+		return n, nil
+	})
+}
+
+func BenchmarkQueue_DequeueN(b *testing.B) {
+	benchmarkDrain(b, "/benchdequeuen", func(q *Queue, n int) (int, error) {
+		jobs, err := q.DequeueN(context.Background(), n)
+		return len(jobs), err
+	})
+}
+
+func TestQueue_Requeue(t *testing.T) {
+	queue := newTestQueue(t, "/requeuekeyprefix", WithMaxAttempts(1))
+	if err := queue.Enqueue("{failingjob}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	item, err := queue.DequeueItem(context.Background())
+	if err != nil {
+		t.Fatalf("failed to dequeue, error: %v", err)
+	}
+	if err := queue.Requeue(item, errors.New("job failed")); err != nil {
+		t.Fatalf("failed to requeue, error: %v", err)
+	}
+	items, err := queue.ListDeadLetters(context.Background())
+	if err != nil {
+		t.Fatalf("failed to list dead letters, error: %v", err)
+	}
+	if len(items) == 0 || items[len(items)-1].LastError != "job failed" {
+		t.Errorf("dead letters got %v", items)
+	}
+}
+
+func TestQueue_ListDeadLettersPages(t *testing.T) {
+	queue := newTestQueue(t, "/dlqpagekeyprefix")
+	ctx := context.Background()
+	const n = listPageSize + 20
+	for i := 0; i < n; i++ {
+		if _, err := newUniqueKV(ctx, queue.client, queue.deadLetterPrefix, fmt.Sprintf("{job%d}", i)); err != nil {
+			t.Fatalf("failed to put dead letter, error: %v", err)
+		}
+	}
+	items, err := queue.ListDeadLetters(ctx)
+	if err != nil {
+		t.Fatalf("failed to list dead letters, error: %v", err)
+	}
+	if len(items) != n {
+		t.Fatalf("dead letters got %d items, want %d", len(items), n)
+	}
+	for i, item := range items {
+		if item.Value != fmt.Sprintf("{job%d}", i) {
+			t.Fatalf("dead letter %d got %s", i, item.Value)
+		}
+	}
+}
+
+// keys outside the dead letter prefix are never read, replayed nor deleted
+func TestQueue_DeadLetterPrefix(t *testing.T) {
+	queue := newTestQueue(t, "/dlqprefixkeyprefix")
+	ctx := context.Background()
+	key, err := queue.EnqueueReturnKeyCtx(ctx, "{job}")
+	if err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	if _, err := queue.GetDeadLetter(ctx, key); err == nil {
+		t.Errorf("get dead letter of queue key %s got no error", key)
+	}
+	items, err := queue.Peek(ctx, 1)
+	if err != nil || len(items) != 1 {
+		t.Fatalf("failed to peek, got %v, error: %v", items, err)
+	}
+	if ok, err := queue.ReplayDeadLetter(ctx, items[0]); ok || err == nil {
+		t.Errorf("replay of queue key %s got %v, error: %v", key, ok, err)
+	}
+	if ok, err := queue.DeleteDeadLetter(ctx, items[0]); ok || err == nil {
+		t.Errorf("delete of queue key %s got %v, error: %v", key, ok, err)
+	}
+	if n, err := queue.Len(ctx); err != nil || n != 1 {
+		t.Errorf("len got %d, error: %v", n, err)
+	}
+}
+
+func TestQueue_EnqueueUnique(t *testing.T) {
+	queue := newTestQueue(t, "/uniquekeyprefix")
+	ctx := context.Background()
+	key, err := queue.EnqueueUnique(ctx, "job-1", "{uniquejob}", time.Minute)
+	if err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	dup, err := queue.EnqueueUnique(ctx, "job-1", "{uniquejob}", time.Minute)
+	if err != ErrKeyExists || dup != key {
+		t.Errorf("duplicate enqueue got %s, error: %v", dup, err)
+	}
+
+	// the dedup key has no lease until the item is dequeued
+	if lease := dedupLease(t, queue, "job-1"); lease != 0 {
+		t.Errorf("dedup key of a queued item has lease %x", lease)
+	}
+	job, err := queue.Dequeue()
+	if err != nil {
+		t.Fatalf("failed to dequeue, error: %v", err)
+	}
+	if job != "{uniquejob}" {
+		t.Errorf("dequeue got %s, want {uniquejob}", job)
+	}
+	if ttl := dedupTTL(t, queue, "job-1"); ttl <= 0 || ttl > 60 {
+		t.Errorf("dedup key after dequeue has ttl %d, want up to 60", ttl)
+	}
+	if _, err := queue.EnqueueUnique(ctx, "job-1", "{uniquejob}", time.Minute); err != ErrKeyExists {
+		t.Errorf("enqueue after dequeue within ttl, error: %v", err)
+	}
+	if n, err := queue.Len(ctx); err != nil || n != 0 {
+		t.Errorf("len got %d, error: %v", n, err)
+	}
+}
+
+// the dedup key of a reserved item gets its lease on Ack, after a Requeue
+func TestQueue_EnqueueUniqueReserve(t *testing.T) {
+	queue := newTestQueue(t, "/uniquereservekeyprefix")
+	ctx := context.Background()
+	if _, err := queue.EnqueueUnique(ctx, "job-1", "{uniquejob}", time.Minute); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	r, err := queue.Reserve(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to reserve, error: %v", err)
+	}
+	if err := r.Requeue(ctx, errors.New("job failed")); err != nil {
+		t.Fatalf("failed to requeue, error: %v", err)
+	}
+	if lease := dedupLease(t, queue, "job-1"); lease != 0 {
+		t.Errorf("dedup key of a requeued item has lease %x", lease)
+	}
+	r, err = queue.Reserve(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to reserve, error: %v", err)
+	}
+	if r.Value() != "{uniquejob}" || r.Item().Attempts != 1 {
+		t.Errorf("reserved %+v after requeue", r.Item())
+	}
+	if lease := dedupLease(t, queue, "job-1"); lease != 0 {
+		t.Errorf("dedup key of a reserved item has lease %x", lease)
+	}
+	if err := r.Ack(ctx); err != nil {
+		t.Fatalf("failed to ack, error: %v", err)
+	}
+	if ttl := dedupTTL(t, queue, "job-1"); ttl <= 0 || ttl > 60 {
+		t.Errorf("dedup key after ack has ttl %d, want up to 60", ttl)
+	}
+}
+
+// a replayed dead letter keeps its dedup key, which gets its lease on dequeue
+func TestQueue_EnqueueUniqueReplay(t *testing.T) {
+	queue := newTestQueue(t, "/uniquereplaykeyprefix", WithMaxAttempts(1))
+	ctx := context.Background()
+	if _, err := queue.EnqueueUnique(ctx, "job-1", "{uniquejob}", time.Minute); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	r, err := queue.Reserve(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to reserve, error: %v", err)
+	}
+	if err := r.Requeue(ctx, errors.New("job failed")); err != nil {
+		t.Fatalf("failed to requeue, error: %v", err)
+	}
+	if n, err := queue.ReplayDeadLetters(ctx); err != nil || n != 1 {
+		t.Fatalf("replay got %d, error: %v", n, err)
+	}
+	if lease := dedupLease(t, queue, "job-1"); lease != 0 {
+		t.Errorf("dedup key of a replayed item has lease %x", lease)
+	}
+	item, err := queue.DequeueItem(ctx)
+	if err != nil || item.Value != "{uniquejob}" || item.Attempts != 0 {
+		t.Fatalf("dequeue after replay got %+v, error: %v", item, err)
+	}
+	if ttl := dedupTTL(t, queue, "job-1"); ttl <= 0 || ttl > 60 {
+		t.Errorf("dedup key after dequeue has ttl %d, want up to 60", ttl)
+	}
+}
+
+func dedupLease(t *testing.T, queue *Queue, dedupKey string) int64 {
+	resp, err := queue.client.Get(context.Background(), queue.dedupKey(dedupKey))
+	if err != nil || len(resp.Kvs) == 0 {
+		t.Fatalf("failed to get dedup key %s, got %v, error: %v", dedupKey, resp, err)
+	}
+	return resp.Kvs[0].Lease
+}
+
+func dedupTTL(t *testing.T, queue *Queue, dedupKey string) int64 {
+	lease := dedupLease(t, queue, dedupKey)
+	if lease == 0 {
+		return 0
+	}
+	resp, err := queue.client.TimeToLive(context.Background(), v3.LeaseID(lease))
+	if err != nil {
+		t.Fatalf("failed to get the ttl of dedup key %s, error: %v", dedupKey, err)
+	}
+	return resp.TTL
+}
+
+type testJob struct {
+	ID   int    `json:"id" msgpack:"id"`
+	Name string `json:"name" msgpack:"name"`
+}
+
+func TestTypedQueue(t *testing.T) {
+	ctx := context.Background()
+	for name, codec := range map[string]Codec{
+		"json":         JSONCodec{},
+		"msgpack":      MsgpackCodec{},
+		"msgpack+gzip": GzipCodec{Codec: MsgpackCodec{}},
+	} {
+		tq := NewTypedQueue[testJob](newTestQueue(t, "/typed"+name), codec)
+		want := testJob{ID: 1, Name: strings.Repeat("job", 100)}
+		if err := tq.Enqueue(ctx, want); err != nil {
+			t.Fatalf("%s: failed to enqueue, error: %v", name, err)
+		}
+		got, item, err := tq.DequeueItem(ctx)
+		if err != nil || got != want {
+			t.Fatalf("%s: dequeue got %v, error: %v", name, got, err)
+		}
+
+		// requeued binary values must survive the envelope
+		if err := tq.Queue().Requeue(item, errors.New("job failed")); err != nil {
+			t.Fatalf("%s: failed to requeue, error: %v", name, err)
+		}
+		if got, err = tq.Dequeue(ctx); err != nil || got != want {
+			t.Errorf("%s: dequeue requeued got %v, error: %v", name, got, err)
+		}
+	}
+}
+
+func TestTypedQueue_Protobuf(t *testing.T) {
+	ctx := context.Background()
+	tq := NewTypedQueue[*wrapperspb.StringValue](newTestQueue(t, "/typedprotobuf"), ProtobufCodec{})
+	if err := tq.Enqueue(ctx, &wrapperspb.StringValue{Value: "{protojob}"}); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	got, err := tq.Dequeue(ctx)
+	if err != nil || got.GetValue() != "{protojob}" {
+		t.Errorf("dequeue got %v, error: %v", got, err)
+	}
+}
+
+func TestTypedQueue_DecodeError(t *testing.T) {
+	ctx := context.Background()
+	queue := newTestQueue(t, "/typeddecodeerror")
+	tq := NewTypedQueue[testJob](queue, JSONCodec{})
+	if err := queue.Enqueue("not json"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	_, err := tq.Dequeue(ctx)
+	var derr *DecodeError
+	if !errors.As(err, &derr) || string(derr.Value) != "not json" {
+		t.Errorf("dequeue got error %v", err)
+	}
+}
+
+func TestMutex_TryLock(t *testing.T) {
+	ctx := context.Background()
+	m1, err := NewEtcdMutex(testEtcdConfig(), "/testlock", 0)
+	if err != nil {
+		t.Fatalf("failed to new mutex, error: %v", err)
+	}
+	defer m1.Close()
+	m2, err := NewEtcdMutex(testEtcdConfig(), "/testlock", 0)
+	if err != nil {
+		t.Fatalf("failed to new mutex, error: %v", err)
+	}
+	defer m2.Close()
+
+	if err := m1.TryLock(ctx); err != nil {
+		t.Fatalf("failed to try lock, error: %v", err)
+	}
+	if err := m2.TryLock(ctx); err != ErrLocked {
+		t.Errorf("try lock of a held mutex, error: %v", err)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if err := m2.Lock(timeoutCtx); err != context.DeadlineExceeded {
+		t.Errorf("lock of a held mutex, error: %v", err)
+	}
+
+	if err := m1.Unlock(ctx); err != nil {
+		t.Fatalf("failed to unlock, error: %v", err)
+	}
+	if err := m2.TryLock(ctx); err != nil {
+		t.Errorf("failed to try lock after unlock, error: %v", err)
+	}
+}
+
+func TestLeaderElector(t *testing.T) {
+	leaders := make(chan string, 2)
+	newElector := func(identity string) *LeaderElector {
+		le, err := NewEtcdLeaderElector(testEtcdConfig(), LeaderElectionConfig{
+			Key:      "/testelection",
+			Identity: identity,
+			Callbacks: LeaderCallbacks{
+				OnStartedLeading: func(ctx context.Context) { leaders <- identity },
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to new leader elector, error: %v", err)
+		}
+		return le
+	}
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	done1 := make(chan error, 1)
+	le1 := newElector("first")
+	go func() { done1 <- le1.Run(ctx1) }()
+	if leader := <-leaders; leader != "first" {
+		t.Fatalf("leader got %s", leader)
+	}
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	le2 := newElector("second")
+	defer le2.Close()
+	go le2.Run(ctx2)
+	select {
+	case leader := <-leaders:
+		t.Fatalf("%s elected while first is leading", leader)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	cancel1()
+	<-done1
+	if le1.IsLeader() {
+		t.Errorf("first is still leader after Run returned")
+	}
+	select {
+	case leader := <-leaders:
+		if leader != "second" {
+			t.Errorf("leader got %s", leader)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("second was not elected after first resigned")
+	}
+	le1.Close()
+}
+
+func TestLeaderElector_Rerun(t *testing.T) {
+	started := make(chan struct{}, 2)
+	le, err := NewEtcdLeaderElector(testEtcdConfig(), LeaderElectionConfig{
+		Key:      "/testrerunelection",
+		Identity: "rerun",
+		Callbacks: LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) { started <- struct{}{} },
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to new leader elector, error: %v", err)
+	}
+	defer le.Close()
+
+	// Run again after it returned, as after losing the leadership
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- le.Run(ctx) }()
+		select {
+		case <-started:
+		case err := <-done:
+			t.Fatalf("run %d returned before elected, error: %v", i+1, err)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("run %d was not elected", i+1)
+		}
+		cancel()
+		<-done
+	}
+}
+
+func TestQueue_Watch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue := newTestQueue(t, "/watchkeyprefix")
+	events, err := queue.Watch(ctx)
+	if err != nil {
+		t.Fatalf("failed to watch, error: %v", err)
+	}
+	if err := queue.Enqueue("{watchjob}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	if _, err := queue.Dequeue(); err != nil {
+		t.Fatalf("failed to dequeue, error: %v", err)
+	}
+	for _, want := range []EventType{EventPut, EventDelete} {
+		ev := <-events
+		if ev.Type != want || ev.Value != "{watchjob}" {
+			t.Errorf("event got %v %s %s, want %v", ev.Type, ev.Key, ev.Value, want)
+		}
+	}
+}
+
+func TestQueue_WatchCompacted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue := newTestQueue(t, "/watchcompactkeyprefix")
+	if err := queue.Enqueue("{oldjob}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	resp, err := queue.client.Get(ctx, "/watchcompactkeyprefix/", v3.WithPrefix())
+	if err != nil {
+		t.Fatalf("failed to get, error: %v", err)
+	}
+	rev := resp.Header.Revision
+	if err := queue.Enqueue("{job}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	if _, err := queue.client.Compact(ctx, rev+1); err != nil {
+		t.Fatalf("failed to compact, error: %v", err)
+	}
+
+	events := queue.WatchFromRev(ctx, rev)
+	if ev := <-events; ev.Type != EventResync || ev.Err != ErrCompacted {
+		t.Fatalf("event got %v, error: %v, want resync", ev.Type, ev.Err)
+	}
+	for _, want := range []string{"{oldjob}", "{job}"} {
+		if ev := <-events; ev.Type != EventPut || ev.Value != want {
+			t.Errorf("event got %v %s, want %s", ev.Type, ev.Value, want)
+		}
+	}
+	if err := queue.Enqueue("{newjob}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	if ev := <-events; ev.Type != EventPut || ev.Value != "{newjob}" {
+		t.Errorf("event got %v %s after resync", ev.Type, ev.Value)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := NewMetrics()
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(metrics); err != nil {
+		t.Fatalf("failed to register metrics, error: %v", err)
+	}
+	queue := newTestQueue(t, "/metricskeyprefix", WithMetrics(metrics))
+	for i := 0; i < 2; i++ {
+		if err := queue.Enqueue(fmt.Sprintf("{job%d}", i)); err != nil {
+			t.Fatalf("failed to enqueue, error: %v", err)
+		}
+	}
+	if _, err := queue.Dequeue(); err != nil {
+		t.Fatalf("failed to dequeue, error: %v", err)
+	}
+
+	if n := testutil.ToFloat64(metrics.enqueued.WithLabelValues("/metricskeyprefix")); n != 2 {
+		t.Errorf("enqueued got %v", n)
+	}
+	if n := testutil.ToFloat64(metrics.dequeued.WithLabelValues("/metricskeyprefix")); n != 1 {
+		t.Errorf("dequeued got %v", n)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics, error: %v", err)
+	}
+	ready := -1.0
+	for _, family := range families {
+		if family.GetName() != "etcdqueue_depth" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetValue() == "ready" {
+					ready = m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	if ready != 1 {
+		t.Errorf("ready depth got %v", ready)
+	}
+}
+
+func TestMetrics_Unregister(t *testing.T) {
+	metrics := NewMetrics()
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(metrics); err != nil {
+		t.Fatalf("failed to register metrics, error: %v", err)
+	}
+	queue := newTestQueue(t, "/unregisterkeyprefix", WithMetrics(metrics))
+	// another queue of the same prefix shares the series
+	other := newTestQueue(t, "/unregisterkeyprefix", WithMetrics(metrics))
+	if err := queue.Enqueue("{job}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	if _, err := other.Dequeue(); err != nil {
+		t.Fatalf("failed to dequeue, error: %v", err)
+	}
+	n := testutil.CollectAndCount(metrics)
+	if n == 0 {
+		t.Fatalf("no series before unregister")
+	}
+	if _, err := registry.Gather(); err != nil {
+		t.Fatalf("failed to gather the queues of one prefix, error: %v", err)
+	}
+
+	metrics.Unregister(queue)
+	if got := testutil.CollectAndCount(metrics); got != n {
+		t.Errorf("got %d series after unregister of one queue, want %d", got, n)
+	}
+	metrics.Unregister(other)
+	if got := testutil.CollectAndCount(metrics); got != 0 {
+		t.Errorf("got %d series after unregister, want 0", got)
+	}
+}
+
+func TestMetrics_Nil(t *testing.T) {
+	queue := newTestQueue(t, "/nilmetricskeyprefix", WithMetrics(nil))
+	if err := queue.Enqueue("{job}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	if _, err := queue.Dequeue(); err != nil {
+		t.Fatalf("failed to dequeue, error: %v", err)
+	}
+	var metrics *Metrics
+	metrics.Unregister(queue)
+}
+
+func TestEtcdConfig_LoadEnv(t *testing.T) {
+	t.Setenv("ETCD_ENDPOINTS", "http://10.0.0.1:2379")
+	t.Setenv("ETCD_DIAL_TIMEOUT", "3s")
+	t.Setenv("ETCD_NAMESPACE", "/env")
+	config := &EtcdConfig{}
+	if err := config.LoadEnv(); err != nil {
+		t.Fatalf("failed to load env, error: %v", err)
+	}
+	fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	config.AddFlags(fs)
+	if err := fs.Parse([]string{"--etcd-namespace=/flag"}); err != nil {
+		t.Fatalf("failed to parse flags, error: %v", err)
+	}
+	if config.Endpoints != "http://10.0.0.1:2379" || config.DialTimeout != 3*time.Second || config.Namespace != "/flag" {
+		t.Errorf("config got %+v", config)
+	}
+
+	t.Setenv("ETCD_DIAL_TIMEOUT", "soon")
+	if err := (&EtcdConfig{}).LoadEnv(); err == nil {
+		t.Errorf("load invalid env got no error")
+	}
+}
+
+func TestEtcdConfig_Namespace(t *testing.T) {
+	config := testEtcdConfig()
+	config.Namespace = "/tenant"
+	client, err := NewETCDClient(config)
+	if err != nil {
+		t.Fatalf("failed to new etcd client, error: %v", err)
+	}
+	defer client.Close()
+	queue := NewQueue(client, "/namespacekeyprefix")
+	key, err := queue.EnqueueReturnKey("{namespacedjob}")
+	if err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+
+	rawQueue := newTestQueue(t, "/namespacekeyprefix")
+	resp, err := rawQueue.client.Get(context.Background(), "/tenant"+key)
+	if err != nil || len(resp.Kvs) != 1 {
+		t.Fatalf("namespaced key got %v, error: %v", resp, err)
+	}
+	if n, err := rawQueue.Len(context.Background()); err != nil || n != 0 {
+		t.Errorf("len outside the namespace got %d, error: %v", n, err)
+	}
+}
+
+func TestQueue_OrderSequence(t *testing.T) {
+	queue := newTestQueue(t, "/seqkeyprefix", WithOrdering(OrderSequence))
+	for i := 0; i < 3; i++ {
+		key, err := queue.EnqueueReturnKey(fmt.Sprintf("{job%d}", i))
+		if err != nil {
+			t.Fatalf("failed to enqueue, error: %v", err)
+		}
+		if want := fmt.Sprintf("/seqkeyprefix/%020d", i+1); key != want {
+			t.Errorf("key got %s, want %s", key, want)
+		}
+	}
+	jobs, err := queue.DequeueN(context.Background(), 3)
+	if err != nil || len(jobs) != 3 || jobs[0] != "{job0}" || jobs[2] != "{job2}" {
+		t.Errorf("dequeue got %v, error: %v", jobs, err)
+	}
+}
+
+func TestQueue_MigrateKeys(t *testing.T) {
+	ctx := context.Background()
+	old := newTestQueue(t, "/migratekeyprefix")
+	for i := 0; i < 2; i++ {
+		if err := old.Enqueue(fmt.Sprintf("{old%d}", i)); err != nil {
+			t.Fatalf("failed to enqueue, error: %v", err)
+		}
+	}
+	if _, err := old.EnqueueWithTTL("{oldttl}", time.Minute); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+
+	queue := newTestQueue(t, "/migratekeyprefix", WithOrdering(OrderSequence))
+	if err := queue.Enqueue("{new}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	n, err := queue.MigrateKeys(ctx)
+	if err != nil || n != 3 {
+		t.Fatalf("migrate got %d, error: %v", n, err)
+	}
+	items, err := queue.Peek(ctx, 3)
+	if err != nil || len(items) != 3 {
+		t.Fatalf("failed to peek, got %v, error: %v", items, err)
+	}
+	resp, err := queue.client.Get(ctx, items[2].Key)
+	if err != nil || len(resp.Kvs) == 0 || resp.Kvs[0].Lease == 0 {
+		t.Errorf("migrated item %s lost its lease, got %v, error: %v", items[2].Key, resp, err)
+	}
+	for _, want := range []string{"{old0}", "{old1}", "{oldttl}", "{new}"} {
+		job, err := queue.Dequeue()
+		if err != nil || job != want {
+			t.Errorf("dequeue got %s, error: %v, want %s", job, err, want)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	store := newTestQueue(t, "/storekeyprefix").Store()
+	rev, err := store.Create(ctx, "a", "1")
+	if err != nil {
+		t.Fatalf("failed to create, error: %v", err)
+	}
+	if _, err := store.Create(ctx, "a", "1"); err != ErrKeyExists {
+		t.Errorf("create existing key, error: %v", err)
+	}
+	if _, err := store.Update(ctx, "missing", "1", 0); err != ErrKeyNotFound {
+		t.Errorf("update missing key, error: %v", err)
+	}
+
+	newRev, err := store.Update(ctx, "a", "2", rev)
+	if err != nil {
+		t.Fatalf("failed to update, error: %v", err)
+	}
+	if _, err := store.Update(ctx, "a", "3", rev); err != ErrConflict {
+		t.Errorf("update with stale revision, error: %v", err)
+	}
+	if err := store.Delete(ctx, "a", rev); err != ErrConflict {
+		t.Errorf("delete with stale revision, error: %v", err)
+	}
+	kv, err := store.Get(ctx, "a")
+	if err != nil || kv.Key != "a" || kv.Value != "2" || kv.Revision != newRev {
+		t.Errorf("get got %+v, error: %v", kv, err)
+	}
+
+	if _, err := store.Create(ctx, "b/c", "4"); err != nil {
+		t.Fatalf("failed to create, error: %v", err)
+	}
+	kvs, err := store.List(ctx, "")
+	if err != nil || len(kvs) != 2 || kvs[1].Key != "b/c" {
+		t.Errorf("list got %v, error: %v", kvs, err)
+	}
+	if err := store.Delete(ctx, "a", newRev); err != nil {
+		t.Errorf("failed to delete, error: %v", err)
+	}
+	if _, err := store.Get(ctx, "a"); err != ErrKeyNotFound {
+		t.Errorf("get deleted key, error: %v", err)
+	}
+}
+
+func TestStore_GuaranteedUpdate(t *testing.T) {
+	ctx := context.Background()
+	store := newTestQueue(t, "/guaranteedkeyprefix").Store()
+	incr := func(old *KeyValue) (string, error) {
+		n := 0
+		if old != nil {
+			fmt.Sscanf(old.Value, "%d", &n)
+		}
+		return fmt.Sprintf("%d", n+1), nil
+	}
+
+	done := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := store.GuaranteedUpdate(ctx, "counter", incr)
+			done <- err
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-done; err != nil {
+			t.Fatalf("failed to update, error: %v", err)
+		}
+	}
+	if kv, err := store.Get(ctx, "counter"); err != nil || kv.Value != "10" {
+		t.Errorf("counter got %+v, error: %v", kv, err)
+	}
+
+	abort := errors.New("abort")
+	if _, err := store.GuaranteedUpdate(ctx, "counter", func(*KeyValue) (string, error) {
+		return "", abort
+	}); err != abort {
+		t.Errorf("aborted update, error: %v", err)
+	}
+}
+
+func TestTopic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	topic, err := NewEtcdTopic(testEtcdConfig(), "/topickeyprefix")
+	if err != nil {
+		t.Fatalf("failed to new etcd topic, error: %v", err)
+	}
+	if _, err := topic.Publish(ctx, "{before}"); err != nil {
+		t.Fatalf("failed to publish, error: %v", err)
+	}
+	var groups []*ConsumerGroup
+	for _, name := range []string{"a", "b"} {
+		g, err := topic.CreateGroup(ctx, name)
+		if err != nil {
+			t.Fatalf("failed to create group, error: %v", err)
+		}
+		groups = append(groups, g)
+	}
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	// two members of group a copy concurrently
+	for _, g := range append(groups, topic.Group("a")) {
+		go g.Run(runCtx)
+	}
+
+	var last int64
+	for i := 0; i < 3; i++ {
+		if last, err = topic.Publish(ctx, fmt.Sprintf("{msg%d}", i)); err != nil {
+			t.Fatalf("failed to publish, error: %v", err)
+		}
+	}
+	for _, g := range groups {
+		for i := 0; i < 3; i++ {
+			val, err := g.Queue().DequeueCtx(ctx)
+			if err != nil || val != fmt.Sprintf("{msg%d}", i) {
+				t.Fatalf("group %s got %s, error: %v", g.Name(), val, err)
+			}
+		}
+		if n, err := g.Queue().Len(ctx); err != nil || n != 0 {
+			t.Errorf("group %s has %d more messages, error: %v", g.Name(), n, err)
+		}
+		if off, err := g.Offset(ctx); err != nil || off != last {
+			t.Errorf("group %s offset got %d, want %d, error: %v", g.Name(), off, last, err)
+		}
+	}
+
+	n, err := topic.Trim(ctx)
+	if err != nil || n != 4 {
+		t.Errorf("trim got %d, error: %v", n, err)
+	}
+	if names, err := topic.Groups(ctx); err != nil || len(names) != 2 {
+		t.Errorf("groups got %v, error: %v", names, err)
+	}
+}
+
+func TestMultiQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mq, err := NewEtcdMultiQueue(testEtcdConfig(), "/multikeyprefix", MultiQueueConfig{
+		Tenants: map[string]TenantConfig{
+			"heavy":   {Weight: 2},
+			"limited": {Rate: 0.001, MaxDepth: 2},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to new etcd multi queue, error: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		if _, err := mq.Enqueue(ctx, "noisy", fmt.Sprintf("{noisy%d}", i)); err != nil {
+			t.Fatalf("failed to enqueue, error: %v", err)
+		}
+	}
+	for _, tenant := range []string{"heavy", "heavy", "heavy", "heavy", "limited", "limited"} {
+		if _, err := mq.Enqueue(ctx, tenant, "{"+tenant+"}"); err != nil {
+			t.Fatalf("failed to enqueue, error: %v", err)
+		}
+	}
+	_, err = mq.Enqueue(ctx, "limited", "{limited}")
+	var full *QueueFullError
+	if !errors.Is(err, ErrQueueFull) || !errors.As(err, &full) || full.Depth != 2 {
+		t.Errorf("enqueue beyond max depth, error: %v", err)
+	}
+
+	// heavy gets two turns per turn of noisy, limited gets one token
+	var got []string
+	for i := 0; i < 7; i++ {
+		tenant, item, err := mq.Dequeue(ctx)
+		if err != nil {
+			t.Fatalf("failed to dequeue, error: %v", err)
+		}
+		if !strings.HasPrefix(item.Value, "{"+tenant) {
+			t.Errorf("tenant %s got %s", tenant, item.Value)
+		}
+		got = append(got, tenant)
+	}
+	want := "heavy,limited,noisy,heavy,heavy,noisy,heavy"
+	if strings.Join(got, ",") != want {
+		t.Errorf("dequeue order got %v, want %s", got, want)
+	}
+
+	if n, err := mq.Tenant("limited").Len(ctx); err != nil || n != 1 {
+		t.Errorf("limited tenant has %d items, error: %v", n, err)
+	}
+	names, err := mq.Tenants(ctx)
+	if err != nil || strings.Join(names, ",") != "heavy,limited,noisy" {
+		t.Errorf("tenants got %v, error: %v", names, err)
+	}
+}
+
+func TestQueue_MoveToAndPurge(t *testing.T) {
+	ctx := context.Background()
+	src := newTestQueue(t, "/movekeyprefix")
+	dst := newTestQueue(t, "/movedkeyprefix")
+	for i := 0; i < 3; i++ {
+		if err := src.EnqueueCtx(ctx, fmt.Sprintf("{job%d}", i)); err != nil {
+			t.Fatalf("failed to enqueue, error: %v", err)
+		}
+	}
+	if n, err := src.MoveTo(ctx, dst, 2); err != nil || n != 2 {
+		t.Fatalf("move got %d, error: %v", n, err)
+	}
+	if _, err := src.MoveTo(ctx, src, 0); err == nil {
+		t.Errorf("move to itself succeeded")
+	}
+	items, err := dst.Peek(ctx, 3)
+	if err != nil || len(items) != 2 || items[0].Value != "{job0}" || items[1].Value != "{job1}" {
+		t.Errorf("moved items got %v, error: %v", items, err)
+	}
+	if n, err := src.Purge(ctx); err != nil || n != 1 {
+		t.Errorf("purge got %d, error: %v", n, err)
+	}
+	if n, err := src.Len(ctx); err != nil || n != 0 {
+		t.Errorf("purged queue has %d items, error: %v", n, err)
+	}
+}
+
+func TestQueue_EnqueueWithTTL(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	metrics := NewMetrics()
+	queue := newTestQueue(t, "/ttlkeyprefix", WithMetrics(metrics))
+	expired := make(chan *Item, 2)
+	go queue.RunExpiryWatcher(ctx, func(item *Item) { expired <- item })
+	// let the watcher start before the items are deleted
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := queue.EnqueueWithTTLCtx(ctx, "{fresh}", time.Second); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	if val, err := queue.DequeueCtx(ctx); err != nil || val != "{fresh}" {
+		t.Fatalf("dequeue got %s, error: %v", val, err)
+	}
+	key, err := queue.EnqueueWithTTLCtx(ctx, "{stale}", time.Second)
+	if err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+
+	select {
+	case item := <-expired:
+		if item.Key != key || item.Value != "{stale}" {
+			t.Errorf("expired item got %+v", item)
+		}
+	case <-ctx.Done():
+		t.Fatalf("item did not expire")
+	}
+	if n, err := queue.Len(ctx); err != nil || n != 0 {
+		t.Errorf("queue has %d items after expiry, error: %v", n, err)
+	}
+	if n := testutil.ToFloat64(metrics.expired.WithLabelValues("/ttlkeyprefix")); n != 1 {
+		t.Errorf("expired_total got %v", n)
+	}
+}
+
+// only the deleted items whose lease is gone are reported, from one lease list
+func TestQueue_ReportExpired(t *testing.T) {
+	ctx := context.Background()
+	queue := newTestQueue(t, "/reportexpiredkeyprefix")
+	live, err := queue.client.Grant(ctx, 60)
+	if err != nil {
+		t.Fatalf("failed to grant lease, error: %v", err)
+	}
+	defer queue.client.Revoke(ctx, live.ID)
+	gone, err := queue.client.Grant(ctx, 60)
+	if err != nil {
+		t.Fatalf("failed to grant lease, error: %v", err)
+	}
+	if _, err := queue.client.Revoke(ctx, gone.ID); err != nil {
+		t.Fatalf("failed to revoke lease, error: %v", err)
+	}
+
+	kv := func(key string, lease v3.LeaseID) *mvccpb.KeyValue {
+		return &mvccpb.KeyValue{Key: []byte(key), Value: []byte("{" + key + "}"), Lease: int64(lease)}
+	}
+	evs := []*v3.Event{
+		{Type: mvccpb.DELETE, Kv: kv("dequeued", 0), PrevKv: kv("dequeued", live.ID)},
+		{Type: mvccpb.DELETE, Kv: kv("expired1", 0), PrevKv: kv("expired1", gone.ID)},
+		{Type: mvccpb.DELETE, Kv: kv("plain", 0), PrevKv: kv("plain", 0)},
+		{Type: mvccpb.PUT, Kv: kv("put", gone.ID)},
+		{Type: mvccpb.DELETE, Kv: kv("expired2", 0), PrevKv: kv("expired2", gone.ID)},
+	}
+	var keys []string
+	if err := queue.reportExpired(ctx, evs, func(item *Item) { keys = append(keys, item.Key) }); err != nil {
+		t.Fatalf("failed to report expired items, error: %v", err)
+	}
+	if strings.Join(keys, ",") != "expired1,expired2" {
+		t.Errorf("expired items got %v", keys)
+	}
+}
+
+func TestQueue_EnqueueBatch(t *testing.T) {
+	ctx := context.Background()
+	queue := newTestQueue(t, "/batchkeyprefix", WithOrdering(OrderSequence))
+	keys, err := queue.EnqueueBatch(ctx, []string{"{job0}", "{job1}", "{job2}"})
+	if err != nil || len(keys) != 3 {
+		t.Fatalf("batch enqueue got %v, error: %v", keys, err)
+	}
+	vals, err := queue.DequeueN(ctx, 3)
+	if err != nil || strings.Join(vals, ",") != "{job0},{job1},{job2}" {
+		t.Errorf("dequeue got %v, error: %v", vals, err)
+	}
+
+	// one more value than the default --max-txn-ops allows with OrderSequence
+	big := make([]string, 127)
+	for i := range big {
+		big[i] = fmt.Sprintf("{job%d}", i)
+	}
+	if _, err := queue.EnqueueBatch(ctx, big); err != ErrTooManyOps {
+		t.Errorf("oversized batch enqueue got error %v, want ErrTooManyOps", err)
+	}
+	if n, err := queue.Len(ctx); err != nil || n != 0 {
+		t.Errorf("len after oversized batch got %d, error: %v", n, err)
+	}
+	if keys, err := queue.EnqueueBatch(ctx, big[:126]); err != nil || len(keys) != 126 {
+		t.Errorf("batch enqueue of 126 got %d keys, error: %v", len(keys), err)
+	}
+}
+
+func TestQueue_DequeueTo(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stage1 := newTestQueue(t, "/stage1keyprefix")
+	stage2 := newTestQueue(t, "/stage2keyprefix")
+	audit := newTestQueue(t, "/auditkeyprefix", WithOrdering(OrderSequence))
+	if err := stage1.EnqueueCtx(ctx, "{job}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	item, err := stage1.DequeueTo(ctx, stage2, audit)
+	if err != nil || item.Value != "{job}" {
+		t.Fatalf("dequeue to got %+v, error: %v", item, err)
+	}
+	if _, err := stage1.DequeueTo(ctx, stage2, stage2); err == nil {
+		t.Errorf("dequeue to a queue twice succeeded")
+	}
+	for _, q := range []*Queue{stage2, audit} {
+		if val, err := q.DequeueCtx(ctx); err != nil || val != "{job}" {
+			t.Errorf("queue %s got %s, error: %v", q.keyPrefix, val, err)
+		}
+	}
+
+	if err := stage1.EnqueueCtx(ctx, "{job}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	r, err := stage1.Reserve(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to reserve, error: %v", err)
+	}
+	if keys, err := r.AckTo(ctx, stage2, "{result0}", "{result1}"); err != nil || len(keys) != 2 {
+		t.Fatalf("ack to got %v, error: %v", keys, err)
+	}
+	if stats, err := stage1.Stats(ctx); err != nil || stats.Len != 0 || stats.InFlight != 0 {
+		t.Errorf("stage1 stats got %+v, error: %v", stats, err)
+	}
+	if n, err := stage2.Len(ctx); err != nil || n != 2 {
+		t.Errorf("stage2 has %d items, error: %v", n, err)
+	}
+}
+
+func TestQueue_ExportImport(t *testing.T) {
+	ctx := context.Background()
+	src := newTestQueue(t, "/exportkeyprefix", WithMaxAttempts(1))
+	vals := []string{"{job0}", "{job1}", "{job2}", "\xff\x00binary", "{job4}"}
+	for _, val := range vals {
+		if err := src.EnqueueCtx(ctx, val); err != nil {
+			t.Fatalf("failed to enqueue, error: %v", err)
+		}
+	}
+	if _, err := src.EnqueueBatch(ctx, []string{"{batch0}", "{batch1}"}); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	item, err := src.DequeueItem(ctx)
+	if err != nil {
+		t.Fatalf("failed to dequeue, error: %v", err)
+	}
+	if err := src.RequeueCtx(ctx, item, errors.New("failed")); err != nil {
+		t.Fatalf("failed to requeue, error: %v", err)
+	}
+	if _, err := src.Reserve(ctx, time.Minute); err != nil {
+		t.Fatalf("failed to reserve, error: %v", err)
+	}
+	// the election key of a running promoter is not exported
+	promoterCtx, promoterCancel := context.WithCancel(ctx)
+	defer promoterCancel()
+	go src.RunPromoter(promoterCtx)
+	for i := 0; ; i++ {
+		resp, err := src.client.Get(ctx, src.keyPrefix+"/"+promoterDir+"/", v3.WithPrefix(), v3.WithCountOnly())
+		if err != nil {
+			t.Fatalf("failed to get promoter key, error: %v", err)
+		}
+		if resp.Count == 1 {
+			break
+		} else if i == 50 {
+			t.Fatalf("promoter was not elected")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var buf strings.Builder
+	n, err := src.Export(ctx, &buf)
+	// 5 items, 1 dead letter, the in-flight item and its lease key
+	if err != nil || n != 8 || strings.Count(buf.String(), "\n") != n {
+		t.Fatalf("export got %d records, error: %v", n, err)
+	}
+	if strings.Contains(buf.String(), promoterDir+"/") {
+		t.Errorf("export got the promoter key: %s", buf.String())
+	}
+
+	dst := newTestQueue(t, "/importkeyprefix")
+	if n, err := dst.Import(ctx, strings.NewReader(buf.String())); err != nil || n != 8 {
+		t.Fatalf("import got %d records, error: %v", n, err)
+	}
+	stats, err := dst.Stats(ctx)
+	if err != nil || stats.Len != 5 || stats.InFlight != 1 || stats.DeadLetters != 1 {
+		t.Errorf("imported stats got %+v, error: %v", stats, err)
+	}
+	items, err := dst.Peek(ctx, 5)
+	if err != nil || len(items) != 5 {
+		t.Fatalf("peek got %v, error: %v", items, err)
+	}
+	for i, want := range []string{"{job2}", "\xff\x00binary", "{job4}"} {
+		if items[i].Value != want {
+			t.Errorf("item %d got %q, want %q", i, items[i].Value, want)
+		}
+	}
+	if _, err := dst.Import(ctx, strings.NewReader(buf.String())); err == nil {
+		t.Errorf("import of existing keys succeeded")
+	}
+
+	// the promoter key of an older export is skipped
+	old := `{"key":"promoter/694d9a1b2c3d4e5f","value":"","createRevision":1,"modRevision":1,"version":1,"lease":1,"ttl":60}`
+	if n, err := dst.Import(ctx, strings.NewReader(old+"\n")); err != nil || n != 0 {
+		t.Errorf("import of a promoter key got %d records, error: %v", n, err)
+	}
+	resp, err := dst.client.Get(ctx, dst.keyPrefix+"/"+promoterDir+"/", v3.WithPrefix(), v3.WithCountOnly())
+	if err != nil || resp.Count != 0 {
+		t.Errorf("imported promoter keys got %v, error: %v", resp, err)
+	}
+}
+
+func TestQueue_ExportPages(t *testing.T) {
+	ctx := context.Background()
+	queue := newTestQueue(t, "/exportpagekeyprefix")
+	// the batches span the page boundary of listPageSize
+	for i := 0; i < 6; i++ {
+		vals := make([]string, 90)
+		for j := range vals {
+			vals[j] = fmt.Sprintf("{job%d}", i*90+j)
+		}
+		if _, err := queue.EnqueueBatch(ctx, vals); err != nil {
+			t.Fatalf("failed to enqueue, error: %v", err)
+		}
+	}
+	var buf strings.Builder
+	if n, err := queue.Export(ctx, &buf); err != nil || n != 540 {
+		t.Fatalf("export got %d records, error: %v", n, err)
+	}
+	dec := json.NewDecoder(strings.NewReader(buf.String()))
+	keys := make(map[string]bool)
+	var last int64
+	for dec.More() {
+		var rec Record
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("invalid record, error: %v", err)
+		}
+		if rec.CreateRevision < last || keys[rec.Key] {
+			t.Fatalf("record %+v out of order or duplicated", rec)
+		}
+		last = rec.CreateRevision
+		keys[rec.Key] = true
+	}
+}
+
+func TestConsumer_ShutdownTimeout(t *testing.T) {
+	queue := newTestQueue(t, "/shutdownkeyprefix")
+	if err := queue.Enqueue("{slowjob}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	started := make(chan struct{})
+	c := NewConsumer(queue, func(ctx context.Context, item Item) error {
+		close(started)
+		<-ctx.Done()
+		return nil
+	}, ConsumerConfig{ShutdownTimeout: 100 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	<-started
+	cancel()
+	if err := <-done; err != ErrShutdownTimeout {
+		t.Errorf("run got %v, want ErrShutdownTimeout", err)
+	}
+}
+
+// runConsumer runs c until the returned stop is called, stop returns the
+// error of Run
+func runConsumer(c *Consumer) (stop func() error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- c.Run(ctx) }()
+	return func() error {
+		cancel()
+		return <-done
+	}
+}
+
+func waitItem(t *testing.T, items <-chan Item) Item {
+	t.Helper()
+	select {
+	case item := <-items:
+		return item
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no item handled")
+		return Item{}
+	}
+}
+
+func TestConsumer_RequeueOnError(t *testing.T) {
+	for _, visibilityTimeout := range []time.Duration{0, 5 * time.Second} {
+		queue := newTestQueue(t, fmt.Sprintf("/consumerrequeue%v", visibilityTimeout))
+		if err := queue.Enqueue("{job}"); err != nil {
+			t.Fatalf("failed to enqueue, error: %v", err)
+		}
+		handled := make(chan Item, 2)
+		stop := runConsumer(NewConsumer(queue, func(ctx context.Context, item Item) error {
+			handled <- item
+			if item.Attempts == 0 {
+				return errors.New("first attempt")
+			}
+			return nil
+		}, ConsumerConfig{VisibilityTimeout: visibilityTimeout}))
+
+		waitItem(t, handled)
+		item := waitItem(t, handled)
+		if err := stop(); err != nil {
+			t.Errorf("run got %v", err)
+		}
+		if item.Value != "{job}" || item.Attempts != 1 || item.LastError != "first attempt" {
+			t.Errorf("retried item got %+v", item)
+		}
+		stats, err := queue.Stats(context.Background())
+		if err != nil {
+			t.Fatalf("failed to get stats, error: %v", err)
+		}
+		if stats.Len != 0 || stats.InFlight != 0 {
+			t.Errorf("stats after retry got %+v, want empty", stats)
+		}
+	}
+}
+
+func TestConsumer_PanicRecovery(t *testing.T) {
+	queue := newTestQueue(t, "/consumerpanic")
+	if err := queue.Enqueue("{job}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	handled := make(chan Item, 1)
+	stop := runConsumer(NewConsumer(queue, func(ctx context.Context, item Item) error {
+		if item.Attempts == 0 {
+			panic("boom")
+		}
+		handled <- item
+		return nil
+	}, ConsumerConfig{}))
+	defer stop()
+
+	item := waitItem(t, handled)
+	if item.Attempts != 1 || item.LastError != "handler panic: boom" {
+		t.Errorf("item after panic got %+v", item)
+	}
+}
+
+func TestConsumer_Timeout(t *testing.T) {
+	queue := newTestQueue(t, "/consumertimeout")
+	if err := queue.Enqueue("{job}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	errs := make(chan error, 1)
+	stop := runConsumer(NewConsumer(queue, func(ctx context.Context, item Item) error {
+		<-ctx.Done()
+		errs <- ctx.Err()
+		return nil
+	}, ConsumerConfig{Timeout: 100 * time.Millisecond}))
+	defer stop()
+
+	select {
+	case err := <-errs:
+		if err != context.DeadlineExceeded {
+			t.Errorf("handler context got %v, want DeadlineExceeded", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("handler context was not cancelled by Timeout")
+	}
+}
+
+func TestConsumer_Concurrency(t *testing.T) {
+	queue := newTestQueue(t, "/consumerconcurrency")
+	const n, concurrency = 12, 3
+	for i := 0; i < n; i++ {
+		if err := queue.Enqueue(fmt.Sprintf("{job%d}", i)); err != nil {
+			t.Fatalf("failed to enqueue, error: %v", err)
+		}
+	}
+	var active, maxActive int32
+	handled := make(chan Item, n)
+	stop := runConsumer(NewConsumer(queue, func(ctx context.Context, item Item) error {
+		cur := atomic.AddInt32(&active, 1)
+		for {
+			max := atomic.LoadInt32(&maxActive)
+			if cur <= max || atomic.CompareAndSwapInt32(&maxActive, max, cur) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		handled <- item
+		return nil
+	}, ConsumerConfig{Concurrency: concurrency}))
+	defer stop()
+
+	for i := 0; i < n; i++ {
+		waitItem(t, handled)
+	}
+	if max := atomic.LoadInt32(&maxActive); max > concurrency || max < 2 {
+		t.Errorf("max concurrent handlers got %d, want 2 to %d", max, concurrency)
+	}
+}
+
+func TestConsumer_GracefulShutdown(t *testing.T) {
+	queue := newTestQueue(t, "/consumerdrain")
+	if err := queue.Enqueue("{job}"); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	var handlerErr atomic.Value
+	stop := runConsumer(NewConsumer(queue, func(ctx context.Context, item Item) error {
+		close(started)
+		<-release
+		handlerErr.Store(fmt.Sprint(ctx.Err()))
+		return nil
+	}, ConsumerConfig{ShutdownTimeout: 10 * time.Second}))
+
+	<-started
+	stopped := make(chan error, 1)
+	go func() { stopped <- stop() }()
+	select {
+	case err := <-stopped:
+		t.Fatalf("run returned %v before the in-flight handler", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	close(release)
+	if err := <-stopped; err != nil {
+		t.Errorf("run got %v, want nil", err)
+	}
+	if err := handlerErr.Load(); err != "<nil>" {
+		t.Errorf("handler context got %v after shutdown, want not cancelled", err)
+	}
+	if n, err := queue.Len(context.Background()); err != nil || n != 0 {
+		t.Errorf("len after drain got %d, %v, want 0", n, err)
+	}
+}
+
+func TestQueue_EnqueueAfter(t *testing.T) {
+	queue := newTestQueue(t, "/delayedkeyprefix")
+	if err := queue.EnqueueAfter("{delayed}", time.Second); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	promoted := make(chan error, 1)
+	go func() { promoted <- queue.RunPromoter(ctx) }()
+
+	ctx1, cancel1 := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel1()
+	if job, err := queue.DequeueCtx(ctx1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("dequeue before the due time got %q, %v, want DeadlineExceeded", job, err)
+	}
+	ctx2, cancel2 := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel2()
+	job, err := queue.DequeueCtx(ctx2)
+	if err != nil {
+		t.Fatalf("failed to dequeue the promoted item, error: %v", err)
+	}
+	if job != "{delayed}" {
+		t.Errorf("dequeue got %s, want {delayed}", job)
+	}
+	cancel()
+	if err := <-promoted; !errors.Is(err, context.Canceled) {
+		t.Errorf("promoter got %v, want Canceled", err)
+	}
+}
+
+func TestQueue_RunPromoterSessionDone(t *testing.T) {
+	defer func(ttl time.Duration) { promoterSessionTTL = ttl }(promoterSessionTTL)
+	promoterSessionTTL = 3 * time.Second
+	queue := newTestQueue(t, "/promotersessionkeyprefix")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	promoted := make(chan error, 1)
+	go func() { promoted <- queue.RunPromoter(ctx) }()
+
+	// revoke the lease of the elected promoter
+	electionKey := path.Join(queue.keyPrefix, promoterDir)
+	for {
+		resp, err := queue.client.Get(ctx, electionKey+"/", v3.WithPrefix())
+		if err != nil {
+			t.Fatalf("failed to get the election key, error: %v", err)
+		}
+		if len(resp.Kvs) > 0 {
+			if _, err := queue.client.Revoke(ctx, v3.LeaseID(resp.Kvs[0].Lease)); err != nil {
+				t.Fatalf("failed to revoke the session, error: %v", err)
+			}
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := <-promoted; err != ErrSessionDone {
+		t.Errorf("promoter got %v, want ErrSessionDone", err)
+	}
+}
+
+// enqueueN puts n items into queue, more than a page of List when n > listPageSize
+func enqueueN(t *testing.T, queue *Queue, n int) {
+	for i := 0; i < n; i++ {
+		if err := queue.Enqueue(fmt.Sprintf("{job%d}", i)); err != nil {
+			t.Fatalf("failed to enqueue, error: %v", err)
+		}
+	}
+}
+
+func TestQueue_ListPages(t *testing.T) {
+	queue := newTestQueue(t, "/listpagekeyprefix")
+	const n = listPageSize + 20
+	enqueueN(t, queue, n)
+	ctx := context.Background()
+
+	var pages []int
+	seen := make(map[string]bool)
+	prev, cursor := "", ""
+	for {
+		items, next, err := queue.List(ctx, cursor, 0)
+		if err != nil {
+			t.Fatalf("failed to list, error: %v", err)
+		}
+		pages = append(pages, len(items))
+		for _, item := range items {
+			if item.Key <= prev || seen[item.Key] {
+				t.Fatalf("list got key %s after %s", item.Key, prev)
+			}
+			seen[item.Key], prev = true, item.Key
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(pages) != 2 || pages[0] != listPageSize || pages[1] != 20 {
+		t.Errorf("list pages got %v, want [%d 20]", pages, listPageSize)
+	}
+	if len(seen) != n {
+		t.Errorf("list got %d items, want %d", len(seen), n)
+	}
+}
+
+// GetAllKeys pages through more than listPageSize keys
+func TestQueue_GetAllKeysPages(t *testing.T) {
+	queue := newTestQueue(t, "/getallkeyprefix")
+	const n = listPageSize + 20
+	enqueueN(t, queue, n)
+	kvs, err := queue.GetAllKeys()
+	if err != nil {
+		t.Fatalf("failed to get all keys, error: %v", err)
+	}
+	if len(kvs) != n {
+		t.Errorf("get all keys got %d keys, want %d", len(kvs), n)
+	}
+}
+
+func TestQueue_Stats(t *testing.T) {
+	queue := newTestQueue(t, "/statskeyprefix", WithMaxAttempts(1))
+	ctx := context.Background()
+	enqueueN(t, queue, 5)
+	// one in-flight, one dead letter and one delayed item, leaving 3 items
+	r, err := queue.Reserve(ctx, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to reserve, error: %v", err)
+	}
+	defer r.Ack(ctx)
+	item, err := queue.DequeueItem(ctx)
+	if err != nil {
+		t.Fatalf("failed to dequeue, error: %v", err)
+	}
+	if err := queue.Requeue(item, errors.New("job failed")); err != nil {
+		t.Fatalf("failed to requeue, error: %v", err)
+	}
+	if err := queue.EnqueueAfter("{delayed}", time.Hour); err != nil {
+		t.Fatalf("failed to enqueue, error: %v", err)
+	}
+
+	stats, err := queue.Stats(ctx)
+	if err != nil {
+		t.Fatalf("failed to get stats, error: %v", err)
+	}
+	if stats.Len != 3 || stats.InFlight != 1 || stats.DeadLetters != 1 || stats.Delayed != 1 {
+		t.Errorf("stats got %+v, want 3 items, 1 in-flight, 1 dead letter and 1 delayed", stats)
+	}
+	first, err := queue.Peek(ctx, 1)
+	if err != nil || len(first) != 1 {
+		t.Fatalf("failed to peek, got %v, error: %v", first, err)
+	}
+	if stats.OldestKey != first[0].Key || stats.OldestAge <= 0 {
+		t.Errorf("oldest got %s aged %v, want %s", stats.OldestKey, stats.OldestAge, first[0].Key)
+	}
+}
@@ -0,0 +1,168 @@
+package etcdqueue
+
+import (
+	"context"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"go.uber.org/zap"
+)
+
+// watchRetryInterval is the wait before a closed or failed watch is resumed
+const watchRetryInterval = time.Second
+
+// EventType is the type of a queue event
+type EventType int
+
+const (
+	// EventPut is an enqueued item
+	EventPut EventType = iota
+	// EventDelete is a dequeued or deleted item
+	EventDelete
+	// EventResync is sent with Err ErrCompacted when the events since the last
+	// seen revision were compacted. It is followed by an EventPut for every item
+	// in the queue at Revision, and then by the events after Revision.
+	EventResync
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "PUT"
+	case EventDelete:
+		return "DELETE"
+	case EventResync:
+		return "RESYNC"
+	}
+	return "UNKNOWN"
+}
+
+// Event is a change of the queue items
+type Event struct {
+	Type     EventType
+	Key      string
+	Value    string
+	Revision int64
+	Err      error
+}
+
+// Watch returns a channel of the changes of the queue items from now on. The
+// watch resumes from the last seen revision after it is closed or fails, and
+// resyncs if that revision was compacted. The channel is closed when ctx is done.
+func (q *Queue) Watch(ctx context.Context) (<-chan Event, error) {
+	resp, err := q.getItems(ctx, v3.WithCountOnly())
+	if err != nil {
+		return nil, err
+	}
+	return q.WatchFromRev(ctx, resp.Header.Revision+1), nil
+}
+
+// WatchFromRev is Watch starting at revision rev
+func (q *Queue) WatchFromRev(ctx context.Context, rev int64) <-chan Event {
+	ch := make(chan Event)
+	go q.watch(ctx, rev, ch)
+	return ch
+}
+
+func (q *Queue) watch(ctx context.Context, rev int64, ch chan<- Event) {
+	defer close(ch)
+	start, end := q.itemRange()
+	send := func(ev Event) bool {
+		select {
+		case ch <- ev:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for ctx.Err() == nil {
+		ctx1, cancel := context.WithCancel(ctx)
+		wc := q.client.Watch(ctx1, start, v3.WithRange(end), v3.WithRev(rev), v3.WithPrevKV())
+		var werr error
+		resynced := false
+		for wresp := range wc {
+			if wresp.CompactRevision != 0 {
+				zap.S().Warnf("watch of queue %s compacted at %d, resyncing", q.keyPrefix, wresp.CompactRevision)
+				next, err := q.resync(ctx, send)
+				if err != nil {
+					werr = err
+				} else {
+					rev, resynced = next, true
+				}
+				break
+			}
+			if werr = wresp.Err(); werr != nil {
+				break
+			}
+			for _, ev := range wresp.Events {
+				if !send(toEvent(ev)) {
+					cancel()
+					return
+				}
+				rev = ev.Kv.ModRevision + 1
+			}
+		}
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if resynced {
+			continue
+		}
+		if werr != nil {
+			zap.S().Errorf("watch of queue %s failed at revision %d, err: %v", q.keyPrefix, rev, werr)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(watchRetryInterval):
+		}
+	}
+}
+
+// resync sends EventResync and the items at the current revision, it returns
+// the revision to resume from
+func (q *Queue) resync(ctx context.Context, send func(Event) bool) (int64, error) {
+	start, end := q.itemRange()
+	var rev int64
+	for {
+		opts := []v3.OpOption{v3.WithRange(end), v3.WithLimit(listPageSize)}
+		if rev != 0 {
+			opts = append(opts, v3.WithRev(rev))
+		}
+		resp, err := q.client.Get(ctx, start, opts...)
+		if err != nil {
+			return 0, err
+		}
+		if rev == 0 {
+			rev = resp.Header.Revision
+			if !send(Event{Type: EventResync, Revision: rev, Err: ErrCompacted}) {
+				return 0, ctx.Err()
+			}
+		}
+		for _, kv := range resp.Kvs {
+			if !send(Event{Type: EventPut, Key: string(kv.Key), Value: decodeItem(kv).Value, Revision: kv.ModRevision}) {
+				return 0, ctx.Err()
+			}
+		}
+		if !resp.More {
+			return rev + 1, nil
+		}
+		start = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+func toEvent(ev *v3.Event) Event {
+	e := Event{Key: string(ev.Kv.Key), Revision: ev.Kv.ModRevision}
+	if ev.Type == mvccpb.DELETE {
+		e.Type = EventDelete
+		if ev.PrevKv != nil {
+			e.Value = decodeItem(ev.PrevKv).Value
+		}
+		return e
+	}
+	e.Type = EventPut
+	e.Value = decodeItem(ev.Kv).Value
+	return e
+}
@@ -0,0 +1,224 @@
+// Package redisbackend implements etcdqueue.Backend on Redis, so that the
+// consumers of etcdqueue run without etcd.
+//
+// A queue is a list of item IDs and two hashes holding the value and the
+// revision of each item, all under the hash tag {<name>} so that they are in
+// one slot of a Redis Cluster. The IDs and revisions come from one counter,
+// every change runs in a Lua script, and enqueues are published so that Wait
+// does not poll. An Update also moves the counter, so it wakes the waiters of
+// an empty queue, which find nothing to claim and wait again.
+package redisbackend
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/huweihuang/golib/etcdqueue"
+)
+
+// the keys of the scripts are seq, list, values, revisions
+var (
+	enqueueScript = redis.NewScript(`
+local id = redis.call('INCR', KEYS[1])
+redis.call('RPUSH', KEYS[2], id)
+redis.call('HSET', KEYS[3], id, ARGV[1])
+redis.call('HSET', KEYS[4], id, id)
+redis.call('PUBLISH', ARGV[2], id)
+return id
+`)
+
+	// claimScript pops the first ID whose item was not deleted, it returns
+	// the current counter if the queue is empty
+	claimScript = redis.NewScript(`
+while true do
+  local id = redis.call('LPOP', KEYS[2])
+  if not id then
+    return {'', '', tonumber(redis.call('GET', KEYS[1]) or '0')}
+  end
+  local val = redis.call('HGET', KEYS[3], id)
+  if val then
+    local rev = redis.call('HGET', KEYS[4], id)
+    redis.call('HDEL', KEYS[3], id)
+    redis.call('HDEL', KEYS[4], id)
+    return {id, val, tonumber(rev)}
+  end
+end
+`)
+
+	getScript = redis.NewScript(`
+local val = redis.call('HGET', KEYS[3], ARGV[1])
+if not val then
+  return false
+end
+return {val, tonumber(redis.call('HGET', KEYS[4], ARGV[1]))}
+`)
+
+	// updateScript and deleteScript return -1 if the item does not exist and
+	// -2 if it is not at the revision. A deleted ID is left in the list and
+	// skipped by claimScript.
+	updateScript = redis.NewScript(`
+local cur = redis.call('HGET', KEYS[4], ARGV[1])
+if not cur then
+  return -1
+end
+if cur ~= ARGV[2] then
+  return -2
+end
+local rev = redis.call('INCR', KEYS[1])
+redis.call('HSET', KEYS[3], ARGV[1], ARGV[3])
+redis.call('HSET', KEYS[4], ARGV[1], rev)
+return rev
+`)
+
+	deleteScript = redis.NewScript(`
+local cur = redis.call('HGET', KEYS[4], ARGV[1])
+if not cur then
+  return -1
+end
+if cur ~= ARGV[2] then
+  return -2
+end
+redis.call('HDEL', KEYS[3], ARGV[1])
+redis.call('HDEL', KEYS[4], ARGV[1])
+return 0
+`)
+)
+
+const (
+	codeNotFound = -1
+	codeConflict = -2
+)
+
+// Backend is a queue on Redis, the keys of its items are their IDs
+type Backend struct {
+	client redis.UniversalClient
+	name   string
+	keys   []string
+}
+
+var _ etcdqueue.Backend = &Backend{}
+
+// New returns the queue name on client
+func New(client redis.UniversalClient, name string) *Backend {
+	prefix := "{" + name + "}:"
+	return &Backend{
+		client: client,
+		name:   name,
+		keys:   []string{prefix + "seq", prefix + "list", prefix + "values", prefix + "revisions"},
+	}
+}
+
+// Name returns the name of the queue
+func (b *Backend) Name() string { return b.name }
+
+func (b *Backend) channel() string {
+	return "{" + b.name + "}:notify"
+}
+
+// Enqueue puts val at the tail of the queue and returns its key
+func (b *Backend) Enqueue(ctx context.Context, val string) (string, error) {
+	id, err := enqueueScript.Run(ctx, b.client, b.keys, val, b.channel()).Int64()
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+// ClaimFirst removes the first item and returns it, or the current revision
+// if the queue is empty
+func (b *Backend) ClaimFirst(ctx context.Context) (*etcdqueue.Item, int64, error) {
+	res, err := claimScript.Run(ctx, b.client, b.keys).Slice()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(res) != 3 {
+		return nil, 0, fmt.Errorf("unexpected claim result %v", res)
+	}
+	id, _ := res[0].(string)
+	val, _ := res[1].(string)
+	rev, _ := res[2].(int64)
+	if id == "" {
+		return nil, rev, nil
+	}
+	return etcdqueue.DecodeItem(id, []byte(val), rev), rev, nil
+}
+
+// Wait blocks until an item is enqueued after rev or ctx is done
+func (b *Backend) Wait(ctx context.Context, rev int64) error {
+	sub := b.client.Subscribe(ctx, b.channel())
+	defer sub.Close()
+	// wait for the subscription before reading the counter, so that no
+	// enqueue is missed in between
+	if _, err := sub.Receive(ctx); err != nil {
+		return err
+	}
+	seq, err := b.client.Get(ctx, b.keys[0]).Int64()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+	if seq > rev {
+		return nil
+	}
+	select {
+	case <-sub.Channel():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Get returns the item of key, or ErrKeyNotFound
+func (b *Backend) Get(ctx context.Context, key string) (*etcdqueue.Item, error) {
+	res, err := getScript.Run(ctx, b.client, b.keys, key).Slice()
+	if err == redis.Nil {
+		return nil, etcdqueue.ErrKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if len(res) != 2 {
+		return nil, fmt.Errorf("unexpected get result %v", res)
+	}
+	val, _ := res[0].(string)
+	rev, _ := res[1].(int64)
+	return etcdqueue.DecodeItem(key, []byte(val), rev), nil
+}
+
+// Update puts the value of key if it is still at rev and returns the new
+// revision, the item keeps its position in the queue
+func (b *Backend) Update(ctx context.Context, key, val string, rev int64) (int64, error) {
+	res, err := updateScript.Run(ctx, b.client, b.keys, key, rev, val).Int64()
+	if err != nil {
+		return 0, err
+	}
+	if err := codeErr(res); err != nil {
+		return 0, err
+	}
+	return res, nil
+}
+
+// Delete deletes key if it is still at rev
+func (b *Backend) Delete(ctx context.Context, key string, rev int64) error {
+	res, err := deleteScript.Run(ctx, b.client, b.keys, key, rev).Int64()
+	if err != nil {
+		return err
+	}
+	return codeErr(res)
+}
+
+// Len returns the number of items
+func (b *Backend) Len(ctx context.Context) (int64, error) {
+	return b.client.HLen(ctx, b.keys[2]).Result()
+}
+
+func codeErr(code int64) error {
+	switch code {
+	case codeNotFound:
+		return etcdqueue.ErrKeyNotFound
+	case codeConflict:
+		return etcdqueue.ErrConflict
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+package redisbackend
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/huweihuang/golib/etcdqueue/backendtest"
+)
+
+func TestBackend(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	backendtest.Run(t, New(client, "test"))
+}
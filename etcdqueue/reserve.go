@@ -0,0 +1,331 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"path"
+	"strings"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"go.uber.org/zap"
+)
+
+const (
+	// inflightDir holds the values of reserved items, <prefix>/inflight/<id>
+	inflightDir = "inflight"
+	// leaseDir holds the session bound keys of reserved items, <prefix>/lease/<id>
+	leaseDir = "lease"
+)
+
+// Reservation is an item moved into the in-flight prefix by Reserve. The item
+// stays there until it is acknowledged, or until the lease of the reserving
+// session expires and the item is redelivered to the queue.
+type Reservation struct {
+	q       *Queue
+	session *concurrency.Session
+	lease   *EphemeralKV
+
+	item        *Item
+	raw         string
+	inflightKey string
+	inflightRev int64
+}
+
+// Key returns the queue key the item was reserved from
+func (r *Reservation) Key() string { return r.item.Key }
+
+// Value returns the item value
+func (r *Reservation) Value() string { return r.item.Value }
+
+// Item returns the reserved item
+func (r *Reservation) Item() *Item { return r.item }
+
+// Ack removes the reserved item, it returns ErrNotReserved if the item
+// was redelivered before the ack.
+func (r *Reservation) Ack(ctx context.Context) error {
+	defer r.session.Close()
+	if err := r.commit(ctx); err != nil {
+		return err
+	}
+	r.q.releaseDedup(ctx, r.item)
+	return nil
+}
+
+// Nack puts the reserved item back into the queue so that it can be dequeued again.
+func (r *Reservation) Nack(ctx context.Context) error {
+	defer r.session.Close()
+	return r.commit(ctx, v3.OpPut(r.item.Key, r.raw))
+}
+
+// Requeue acks the reserved item and puts it back to the tail of the queue
+// with its attempt count increased in one txn, or into the dead letter queue
+// after the max attempts like Queue.Requeue. It returns ErrNotReserved if the
+// item was redelivered before, then nothing is put.
+func (r *Reservation) Requeue(ctx context.Context, err error) error {
+	defer r.session.Close()
+	data, attempts, merr := encodeRequeue(r.item, err)
+	if merr != nil {
+		return merr
+	}
+	q := r.q
+	cmp := v3.Compare(v3.ModRevision(r.inflightKey), "=", r.inflightRev)
+	release := []v3.Op{v3.OpDelete(r.inflightKey), v3.OpDelete(r.lease.Key())}
+	if attempts < q.maxAttempts {
+		newKey, _, err := q.putItem(ctx, data, []v3.Cmp{cmp}, func(string) []v3.Op { return release })
+		if err != nil {
+			return err
+		} else if newKey == "" {
+			return ErrNotReserved
+		}
+		return nil
+	}
+
+	zap.S().Debugf("item %s failed %d attempts, moving to %s", r.item.Key, attempts, q.deadLetterPrefix)
+	for {
+		newKey := fmt.Sprintf("%s/%v", q.deadLetterPrefix, time.Now().UnixNano())
+		guard := v3.Compare(v3.Version(newKey), "=", 0)
+		puts := append([]v3.Op{v3.OpPut(newKey, data)}, release...)
+		txnresp, err := q.client.Txn(ctx).If(cmp).Then(v3.OpTxn([]v3.Cmp{guard}, puts, nil)).Commit()
+		if err != nil {
+			return err
+		} else if !txnresp.Succeeded {
+			return ErrNotReserved
+		}
+		if txnresp.Responses[0].GetResponseTxn().Succeeded {
+			return nil
+		}
+		// the dead letter key already exists, retry with another one
+	}
+}
+
+func (r *Reservation) commit(ctx context.Context, ops ...v3.Op) error {
+	cmp := v3.Compare(v3.ModRevision(r.inflightKey), "=", r.inflightRev)
+	ops = append(ops, v3.OpDelete(r.inflightKey), v3.OpDelete(r.lease.Key()))
+	txnresp, err := r.q.client.Txn(ctx).If(cmp).Then(ops...).Commit()
+	if err != nil {
+		return err
+	} else if !txnresp.Succeeded {
+		return ErrNotReserved
+	}
+	return nil
+}
+
+// Reserve moves the first item into the in-flight prefix instead of deleting it.
+// The reservation is bound to a session lease with visibilityTimeout as TTL, if
+// the worker dies before Ack or Nack, the lease expires and the item is redelivered
+// by Redeliver or RunRedelivery. If the queue is empty, Reserve blocks until
+// elements are available.
+//
+// The session is kept alive until the reservation is acked, nacked or
+// requeued, or the queue is closed, so visibilityTimeout only bounds how long
+// the item is held after its worker died or lost etcd. A live worker holds it
+// as long as it handles it, bound the handling with the ctx of the handler.
+func (q *Queue) Reserve(ctx context.Context, visibilityTimeout time.Duration) (*Reservation, error) {
+	ttl := int(math.Ceil(visibilityTimeout.Seconds()))
+	if ttl < 1 {
+		ttl = 1
+	}
+	start := time.Now()
+	session, err := concurrency.NewSession(q.client,
+		concurrency.WithTTL(ttl), concurrency.WithContext(q.ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := q.reserve(ctx, session)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	q.observeDequeue("reserve", start, 1)
+	return r, nil
+}
+
+func (q *Queue) reserve(ctx context.Context, s *concurrency.Session) (*Reservation, error) {
+	for {
+		resp, err := q.getItems(ctx, q.orderOpts(), v3.WithLimit(1))
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			r, err := q.claimReservation(ctx, s, kv)
+			if err == ErrKeyExists {
+				// another client is claiming the item, wait for it instead of
+				// spinning on the same first key
+				q.metrics.claimConflict(q.keyPrefix, 1)
+				if err := q.waitClaim(ctx, kv, resp.Header.Revision); err != nil {
+					return nil, err
+				}
+				continue
+			} else if err != nil {
+				return nil, err
+			} else if r != nil {
+				return r, nil
+			}
+			q.metrics.claimConflict(q.keyPrefix, 1)
+		}
+		if len(resp.Kvs) != 0 || resp.More {
+			// lost the item to another client, retry to read in more
+			if resp.More {
+				q.metrics.moreRetry(q.keyPrefix)
+			}
+			continue
+		}
+
+		// nothing yet; wait on elements
+		if _, err := q.waitItemPut(ctx, resp.Header.Revision); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// claimReservation moves kv into the in-flight prefix, returning nil if the
+// item was claimed by another client, or ErrKeyExists if another client holds
+// its lease key and is still claiming it. The lease key is created first, so
+// an in-flight item without its lease key is always an expired reservation.
+func (q *Queue) claimReservation(ctx context.Context, s *concurrency.Session,
+	kv *mvccpb.KeyValue) (*Reservation, error) {
+	id := path.Base(string(kv.Key))
+	lease, err := newEphemeralKV(ctx, s, q.leaseKey(id), "")
+	if err != nil {
+		return nil, err
+	}
+
+	inflightKey := q.inflightKey(id)
+	cmp := v3.Compare(v3.ModRevision(string(kv.Key)), "=", kv.ModRevision)
+	txnresp, err := q.client.Txn(ctx).If(cmp).Then(
+		v3.OpDelete(string(kv.Key)),
+		v3.OpPut(inflightKey, string(kv.Value)),
+	).Commit()
+	if err != nil || !txnresp.Succeeded {
+		if derr := lease.Delete(); derr != nil {
+			zap.S().Errorf("failed to delete lease key %s, err: %v", lease.Key(), derr)
+		}
+		return nil, err
+	}
+
+	return &Reservation{
+		q:           q,
+		session:     s,
+		lease:       lease,
+		item:        decodeItem(kv),
+		raw:         string(kv.Value),
+		inflightKey: inflightKey,
+		inflightRev: txnresp.Header.Revision,
+	}, nil
+}
+
+// waitClaim waits until another client ends its claim of kv, which deletes
+// either the item or its own lease key after rev. If that client died in
+// between, its lease key expires with its visibility timeout.
+func (q *Queue) waitClaim(ctx context.Context, kv *mvccpb.KeyValue, rev int64) error {
+	ctx1, cancel := context.WithCancel(ctx)
+	defer cancel()
+	opts := []v3.OpOption{v3.WithRev(rev + 1), v3.WithFilterPut()}
+	itemc := q.client.Watch(ctx1, string(kv.Key), opts...)
+	leasec := q.client.Watch(ctx1, q.leaseKey(path.Base(string(kv.Key))), opts...)
+
+	var wresp v3.WatchResponse
+	var ok bool
+	select {
+	case wresp, ok = <-itemc:
+	case wresp, ok = <-leasec:
+	}
+	if !ok {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return ErrWatchClosed
+	}
+	return wresp.Err()
+}
+
+// Redeliver moves the in-flight items whose lease has expired back to the
+// queue and returns the number of redelivered items.
+func (q *Queue) Redeliver(ctx context.Context) (int, error) {
+	n, _, err := q.redeliverExpired(ctx)
+	return n, err
+}
+
+// RunRedelivery redelivers expired in-flight items until ctx is done. It sweeps
+// the in-flight prefix once and then watches for lease keys being removed.
+func (q *Queue) RunRedelivery(ctx context.Context) error {
+	_, rev, err := q.redeliverExpired(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx1, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wc := q.client.Watch(ctx1, q.leaseKey(""), v3.WithPrefix(), v3.WithRev(rev+1), v3.WithFilterPut())
+	for wresp := range wc {
+		if err := wresp.Err(); err != nil {
+			return err
+		}
+		for _, ev := range wresp.Events {
+			if ev.Type != mvccpb.DELETE {
+				continue
+			}
+			resp, err := q.client.Get(ctx, q.inflightKey(path.Base(string(ev.Kv.Key))))
+			if err != nil {
+				return err
+			}
+			for _, kv := range resp.Kvs {
+				if _, err := q.redeliver(ctx, kv); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// redeliverExpired returns the number of redelivered items and the revision of the sweep
+func (q *Queue) redeliverExpired(ctx context.Context) (int, int64, error) {
+	resp, err := q.client.Get(ctx, q.inflightKey(""), v3.WithPrefix())
+	if err != nil {
+		return 0, 0, err
+	}
+	n := 0
+	for _, kv := range resp.Kvs {
+		ok, err := q.redeliver(ctx, kv)
+		if err != nil {
+			return n, 0, err
+		} else if ok {
+			n++
+		}
+	}
+	return n, resp.Header.Revision, nil
+}
+
+// redeliver moves an in-flight kv back to the queue if its lease key is gone
+func (q *Queue) redeliver(ctx context.Context, kv *mvccpb.KeyValue) (bool, error) {
+	id := path.Base(string(kv.Key))
+	cmps := []v3.Cmp{
+		v3.Compare(v3.ModRevision(string(kv.Key)), "=", kv.ModRevision),
+		v3.Compare(v3.CreateRevision(q.leaseKey(id)), "=", 0),
+	}
+	txnresp, err := q.client.Txn(ctx).If(cmps...).Then(
+		v3.OpDelete(string(kv.Key)),
+		v3.OpPut(strings.Join([]string{q.keyPrefix, id}, "/"), string(kv.Value)),
+	).Commit()
+	if err != nil {
+		return false, err
+	}
+	if txnresp.Succeeded {
+		zap.S().Debugf("redelivered expired item %s in queue %s", id, q.keyPrefix)
+	}
+	return txnresp.Succeeded, nil
+}
+
+func (q *Queue) inflightKey(id string) string {
+	return strings.Join([]string{q.keyPrefix, inflightDir, id}, "/")
+}
+
+func (q *Queue) leaseKey(id string) string {
+	return strings.Join([]string{q.keyPrefix, leaseDir, id}, "/")
+}
@@ -0,0 +1,224 @@
+// Package sqlbackend implements etcdqueue.Backend on a SQL table with gorm,
+// so that the consumers of etcdqueue run on MySQL without etcd.
+//
+// The queues share one table, an item is a row whose auto increment ID is its
+// position in the queue. Workers claim the first row by SELECT ... FOR UPDATE
+// SKIP LOCKED, which needs MySQL 8.0 and does not block on the rows claimed
+// by other workers. Wait polls for such a row, as MySQL does not notify the
+// inserts.
+package sqlbackend
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/huweihuang/golib/etcdqueue"
+)
+
+const (
+	// DefaultTable is the table of the queues
+	DefaultTable = "queue_items"
+
+	defaultPollInterval = time.Second
+)
+
+// Row is a queue item in the table
+type Row struct {
+	ID        int64  `gorm:"primaryKey"`
+	Queue     string `gorm:"size:191;not null"`
+	Value     []byte `gorm:"not null"`
+	Revision  int64  `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+// Backend is a queue on a SQL table, the keys of its items are their IDs
+type Backend struct {
+	db           *gorm.DB
+	table        string
+	queue        string
+	pollInterval time.Duration
+}
+
+var _ etcdqueue.Backend = &Backend{}
+
+// Option configures a Backend
+type Option func(*Backend)
+
+// WithTable sets the table of the queue, DefaultTable by default
+func WithTable(table string) Option {
+	return func(b *Backend) {
+		b.table = table
+	}
+}
+
+// WithPollInterval sets how often Wait looks for new rows, 1s by default
+func WithPollInterval(interval time.Duration) Option {
+	return func(b *Backend) {
+		b.pollInterval = interval
+	}
+}
+
+// New returns the queue named queue on db, such as the db.DB of golib
+func New(db *gorm.DB, queue string, opts ...Option) *Backend {
+	b := &Backend{db: db, table: DefaultTable, queue: queue, pollInterval: defaultPollInterval}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// Migrate creates or updates the table and its (queue, id) index, which
+// serves the claim of the first row of a queue
+func (b *Backend) Migrate(ctx context.Context) error {
+	db := b.db.WithContext(ctx).Table(b.table)
+	if err := db.AutoMigrate(&Row{}); err != nil {
+		return err
+	}
+	// named by table, as the index names of sqlite are global
+	index := "idx_" + b.table + "_queue_id"
+	if db.Migrator().HasIndex(&Row{}, index) {
+		return nil
+	}
+	return b.db.WithContext(ctx).Exec("CREATE INDEX ? ON ? (queue, id)",
+		clause.Column{Name: index}, clause.Table{Name: b.table}).Error
+}
+
+// Name returns the name of the queue
+func (b *Backend) Name() string { return b.queue }
+
+func (b *Backend) rows(tx *gorm.DB) *gorm.DB {
+	return tx.Table(b.table).Where("queue = ?", b.queue)
+}
+
+// Enqueue puts val at the tail of the queue and returns its key
+func (b *Backend) Enqueue(ctx context.Context, val string) (string, error) {
+	row := &Row{Queue: b.queue, Value: []byte(val), Revision: 1}
+	if err := b.db.WithContext(ctx).Table(b.table).Create(row).Error; err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(row.ID, 10), nil
+}
+
+// skipLocked makes a select lock its rows and skip the rows locked by other
+// workers, sqlite ignores it
+var skipLocked = clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}
+
+// firstRow selects the first row not locked by another worker and locks it
+// until tx ends
+func (b *Backend) firstRow(tx *gorm.DB) *gorm.DB {
+	return b.rows(tx).Clauses(skipLocked).Order("id").Limit(1)
+}
+
+// ClaimFirst deletes the first row not locked by another worker and returns
+// it. The revision is unused by Wait, it is always 0.
+func (b *Backend) ClaimFirst(ctx context.Context) (*etcdqueue.Item, int64, error) {
+	var row Row
+	err := b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := b.firstRow(tx).Find(&row).Error
+		if err != nil || row.ID == 0 {
+			return err
+		}
+		return tx.Table(b.table).Where("id = ?", row.ID).Delete(&Row{}).Error
+	})
+	if err != nil || row.ID == 0 {
+		return nil, 0, err
+	}
+	return b.toItem(&row), 0, nil
+}
+
+// Wait polls until the queue has a row not locked by another worker or ctx
+// is done. It does not poll for the IDs after rev, as auto increment IDs may
+// commit out of order and a row with a smaller ID would be missed.
+func (b *Backend) Wait(ctx context.Context, rev int64) error {
+	ticker := time.NewTicker(b.pollInterval)
+	defer ticker.Stop()
+	for {
+		var ids []int64
+		err := b.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			return b.firstRow(tx).Pluck("id", &ids).Error
+		})
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Get returns the item of key, or ErrKeyNotFound
+func (b *Backend) Get(ctx context.Context, key string) (*etcdqueue.Item, error) {
+	id, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return nil, etcdqueue.ErrKeyNotFound
+	}
+	var row Row
+	err = b.rows(b.db.WithContext(ctx)).Where("id = ?", id).Take(&row).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, etcdqueue.ErrKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return b.toItem(&row), nil
+}
+
+// Update puts the value of key if it is still at rev and returns the new
+// revision, the item keeps its position in the queue
+func (b *Backend) Update(ctx context.Context, key, val string, rev int64) (int64, error) {
+	id, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return 0, etcdqueue.ErrKeyNotFound
+	}
+	res := b.rows(b.db.WithContext(ctx)).Where("id = ? AND revision = ?", id, rev).
+		Updates(map[string]interface{}{"value": []byte(val), "revision": rev + 1})
+	if err := b.checkRows(ctx, res, id); err != nil {
+		return 0, err
+	}
+	return rev + 1, nil
+}
+
+// Delete deletes key if it is still at rev
+func (b *Backend) Delete(ctx context.Context, key string, rev int64) error {
+	id, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return etcdqueue.ErrKeyNotFound
+	}
+	res := b.rows(b.db.WithContext(ctx)).Where("id = ? AND revision = ?", id, rev).Delete(&Row{})
+	return b.checkRows(ctx, res, id)
+}
+
+// checkRows tells why a compare-and-swap on the row id affected no rows
+func (b *Backend) checkRows(ctx context.Context, res *gorm.DB, id int64) error {
+	if res.Error != nil || res.RowsAffected > 0 {
+		return res.Error
+	}
+	var count int64
+	if err := b.rows(b.db.WithContext(ctx)).Where("id = ?", id).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return etcdqueue.ErrKeyNotFound
+	}
+	return etcdqueue.ErrConflict
+}
+
+// Len returns the number of items
+func (b *Backend) Len(ctx context.Context) (int64, error) {
+	var count int64
+	err := b.rows(b.db.WithContext(ctx)).Count(&count).Error
+	return count, err
+}
+
+func (b *Backend) toItem(row *Row) *etcdqueue.Item {
+	return etcdqueue.DecodeItem(strconv.FormatInt(row.ID, 10), row.Value, row.Revision)
+}
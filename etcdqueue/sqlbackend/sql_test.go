@@ -0,0 +1,141 @@
+package sqlbackend
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+
+	"github.com/huweihuang/golib/etcdqueue/backendtest"
+)
+
+func openSqlite(t *testing.T) *gorm.DB {
+	dsn := filepath.Join(t.TempDir(), "queue.db") + "?_pragma=busy_timeout(5000)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestBackend(t *testing.T) {
+	// sqlite ignores FOR UPDATE SKIP LOCKED and serializes the writers, the
+	// locking is tested by TestBackend_SkipLocked
+	db := openSqlite(t)
+	b := New(db, "test", WithPollInterval(20*time.Millisecond))
+	if err := b.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// another queue in the table is invisible to b
+	if _, err := New(db, "other").Enqueue(context.Background(), "x"); err != nil {
+		t.Fatal(err)
+	}
+	backendtest.Run(t, b)
+}
+
+// a row committed after a greater ID is still found by Wait
+func TestBackend_WaitIgnoresRevision(t *testing.T) {
+	db := openSqlite(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	b := New(db, "test", WithPollInterval(20*time.Millisecond))
+	if err := b.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Enqueue(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Wait(ctx, 100); err != nil {
+		t.Fatalf("Wait with a row of a smaller ID = %v", err)
+	}
+}
+
+func TestBackend_Migrate(t *testing.T) {
+	db := openSqlite(t)
+	ctx := context.Background()
+	for _, table := range []string{"a_items", "b_items"} {
+		b := New(db, "test", WithTable(table))
+		// the second run finds the index
+		for i := 0; i < 2; i++ {
+			if err := b.Migrate(ctx); err != nil {
+				t.Fatalf("Migrate %s = %v", table, err)
+			}
+		}
+		if !db.Table(table).Migrator().HasIndex(&Row{}, "idx_"+table+"_queue_id") {
+			t.Fatalf("table %s has no (queue, id) index", table)
+		}
+	}
+}
+
+// the claim of MySQL locks the first row and skips the rows of other workers
+func TestBackend_ClaimSQL(t *testing.T) {
+	db, err := gorm.Open(mysql.New(mysql.Config{SkipInitializeWithVersion: true}),
+		&gorm.Config{DryRun: true, DisableAutomaticPing: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var row Row
+	sql := New(db, "test").firstRow(db).Find(&row).Statement.SQL.String()
+	want := "SELECT * FROM `queue_items` WHERE queue = ? ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED"
+	if sql != want {
+		t.Fatalf("claim SQL = %q, want %q", sql, want)
+	}
+}
+
+// TestBackend_SkipLocked runs on the MySQL 8.0 of SQLBACKEND_MYSQL_DSN, such as
+// root:password@tcp(127.0.0.1:3306)/test?parseTime=true
+func TestBackend_SkipLocked(t *testing.T) {
+	dsn := os.Getenv("SQLBACKEND_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("SQLBACKEND_MYSQL_DSN is not set")
+	}
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	table := "queue_items_" + strings.ReplaceAll(time.Now().Format("150405.000"), ".", "")
+	defer db.Migrator().DropTable(table)
+	b := New(db, "test", WithTable(table), WithPollInterval(20*time.Millisecond))
+	if err := b.Migrate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Backend", func(t *testing.T) { backendtest.Run(t, b) })
+
+	for _, val := range []string{"a", "b"} {
+		if _, err := b.Enqueue(ctx, val); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// hold the lock of the first row while another worker claims
+	tx := db.WithContext(ctx).Begin()
+	defer tx.Rollback()
+	var locked Row
+	if err := b.firstRow(tx).Find(&locked).Error; err != nil {
+		t.Fatal(err)
+	}
+	if string(locked.Value) != "a" {
+		t.Fatalf("locked row = %s, want a", locked.Value)
+	}
+	claimCtx, claimCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer claimCancel()
+	item, _, err := b.ClaimFirst(claimCtx)
+	if err != nil {
+		t.Fatalf("ClaimFirst blocked by a locked row: %v", err)
+	}
+	if item == nil || item.Value != "b" {
+		t.Fatalf("ClaimFirst = %+v, want b", item)
+	}
+	tx.Rollback()
+	if item, _, err := b.ClaimFirst(ctx); err != nil || item == nil || item.Value != "a" {
+		t.Fatalf("ClaimFirst after the unlock = %+v, %v, want a", item, err)
+	}
+}
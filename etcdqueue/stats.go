@@ -0,0 +1,115 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+)
+
+// listPageSize is the page size used to walk a whole prefix
+const listPageSize = 500
+
+// Stats is a snapshot of the queue
+type Stats struct {
+	Len         int64
+	InFlight    int64
+	DeadLetters int64
+	Delayed     int64
+	// OldestKey and OldestAge are the key and age of the oldest item,
+	// empty if the queue is empty. The age is counted from the creation of
+	// the key: the enqueue, or the last Requeue, ReplayDeadLetter, MoveTo or
+	// promotion of a delayed item, which put the item under a new key. Nack
+	// and redelivery put back the original key, so they keep its age.
+	// OldestAge is zero with OrderSequence, whose keys hold no time.
+	OldestKey string
+	OldestAge time.Duration
+	Revision  int64
+}
+
+// Len returns the number of items in the queue, excluding in-flight,
+// dead letter and delayed items
+func (q *Queue) Len(ctx context.Context) (int64, error) {
+	resp, err := q.getItems(ctx, v3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// Peek returns up to n items in Dequeue order without removing them
+func (q *Queue) Peek(ctx context.Context, n int) ([]*Item, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	resp, err := q.getItems(ctx, q.orderOpts(), v3.WithLimit(int64(n)))
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*Item, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		items = append(items, decodeItem(kv))
+	}
+	return items, nil
+}
+
+// List returns up to limit items sorted by key after cursor, an empty cursor
+// starts from the first item. The returned cursor is passed to the next call
+// to continue, it is empty when all items were listed.
+func (q *Queue) List(ctx context.Context, cursor string, limit int) ([]*Item, string, error) {
+	if limit <= 0 {
+		limit = listPageSize
+	}
+	start, end := q.itemRange()
+	if cursor != "" {
+		start = cursor + "\x00"
+	}
+	resp, err := q.client.Get(ctx, start, v3.WithRange(end), v3.WithLimit(int64(limit)))
+	if err != nil {
+		return nil, "", err
+	}
+	items := make([]*Item, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		items = append(items, decodeItem(kv))
+	}
+	next := ""
+	if resp.More && len(items) != 0 {
+		next = items[len(items)-1].Key
+	}
+	return items, next, nil
+}
+
+// Stats returns the counts of the queue and the age of the oldest item,
+// read in one transaction so that they are consistent with each other.
+func (q *Queue) Stats(ctx context.Context) (*Stats, error) {
+	start, end := q.itemRange()
+	prefixCount := func(prefix string) v3.Op {
+		return v3.OpGet(prefix, v3.WithPrefix(), v3.WithCountOnly())
+	}
+	txnresp, err := q.client.Txn(ctx).Then(
+		v3.OpGet(start, v3.WithRange(end), v3.WithCountOnly()),
+		prefixCount(q.inflightKey("")),
+		prefixCount(q.deadLetterPrefix+"/"),
+		prefixCount(q.delayedKey("")),
+		v3.OpGet(start, v3.WithRange(end), v3.WithKeysOnly(), q.orderOpts(), v3.WithLimit(1)),
+	).Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{Revision: txnresp.Header.Revision}
+	counts := []*int64{&stats.Len, &stats.InFlight, &stats.DeadLetters, &stats.Delayed}
+	for i, count := range counts {
+		*count = txnresp.Responses[i].GetResponseRange().Count
+	}
+	if kvs := txnresp.Responses[len(counts)].GetResponseRange().Kvs; len(kvs) != 0 {
+		stats.OldestKey = string(kvs[0].Key)
+		var nsec int64
+		if _, err := fmt.Sscanf(path.Base(stats.OldestKey), "%d", &nsec); err == nil && q.ordering == OrderTimestamp {
+			stats.OldestAge = time.Since(time.Unix(0, nsec))
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,179 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+)
+
+// Store is a key value store under a prefix, all keys are relative to the
+// prefix. Update and Delete take the revision read by Get for optimistic
+// concurrency, a zero revision skips the check.
+type Store struct {
+	client *v3.Client
+	prefix string
+}
+
+// KeyValue is a stored value with its revisions
+type KeyValue struct {
+	Key            string
+	Value          string
+	Revision       int64
+	CreateRevision int64
+	Version        int64
+}
+
+// UpdateFunc returns the new value from the current one, which is nil if the
+// key does not exist. Returning an error aborts GuaranteedUpdate.
+type UpdateFunc func(old *KeyValue) (string, error)
+
+// NewStore new a store under prefix
+func NewStore(client *v3.Client, prefix string) *Store {
+	return &Store{client: client, prefix: strings.TrimSuffix(prefix, "/")}
+}
+
+// NewEtcdStore new a store with a new etcd client
+func NewEtcdStore(etcdConfig *EtcdConfig, prefix string) (*Store, error) {
+	etcdClient, err := NewETCDClient(etcdConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new etcd client, err: %v", err)
+	}
+	return NewStore(etcdClient, prefix), nil
+}
+
+// Store returns a store on the prefix of the queue
+func (q *Queue) Store() *Store {
+	return NewStore(q.client, q.keyPrefix)
+}
+
+// Create puts a new key and returns its revision, or ErrKeyExists
+func (s *Store) Create(ctx context.Context, key, val string) (int64, error) {
+	return putNewKV(ctx, s.client, s.fullKey(key), val, v3.NoLease)
+}
+
+// Get returns the value of key, or ErrKeyNotFound
+func (s *Store) Get(ctx context.Context, key string) (*KeyValue, error) {
+	resp, err := s.client.Get(ctx, s.fullKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return s.toKeyValue(resp.Kvs[0]), nil
+}
+
+// Update puts the value of an existing key if it is still at rev, and
+// returns the new revision. It returns ErrKeyNotFound if the key does not
+// exist and ErrConflict if it was modified since rev.
+func (s *Store) Update(ctx context.Context, key, val string, rev int64) (int64, error) {
+	resp, err := s.commit(ctx, key, rev, v3.OpPut(s.fullKey(key), val))
+	if err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+// Delete deletes key if it is still at rev, it returns ErrKeyNotFound if the
+// key does not exist and ErrConflict if it was modified since rev.
+func (s *Store) Delete(ctx context.Context, key string, rev int64) error {
+	_, err := s.commit(ctx, key, rev, v3.OpDelete(s.fullKey(key)))
+	return err
+}
+
+// List returns the keys under the relative prefix sorted by key, paging
+// through the range so that large prefixes do not exceed the response size.
+func (s *Store) List(ctx context.Context, prefix string) ([]*KeyValue, error) {
+	start := s.fullKey(prefix)
+	end := v3.GetPrefixRangeEnd(start)
+	var kvs []*KeyValue
+	for {
+		resp, err := s.client.Get(ctx, start, v3.WithRange(end), v3.WithLimit(listPageSize))
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			kvs = append(kvs, s.toKeyValue(kv))
+		}
+		if !resp.More || len(resp.Kvs) == 0 {
+			return kvs, nil
+		}
+		start = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+	}
+}
+
+// GuaranteedUpdate reads key, applies tryUpdate and writes the result if the
+// key was not modified in between, retrying with the current value on
+// conflicts. The key is created if it does not exist.
+func (s *Store) GuaranteedUpdate(ctx context.Context, key string, tryUpdate UpdateFunc) (*KeyValue, error) {
+	full := s.fullKey(key)
+	old, err := s.Get(ctx, key)
+	if err != nil && err != ErrKeyNotFound {
+		return nil, err
+	}
+	for {
+		val, err := tryUpdate(old)
+		if err != nil {
+			return nil, err
+		}
+		cmp := v3.Compare(v3.Version(full), "=", 0)
+		if old != nil {
+			cmp = v3.Compare(v3.ModRevision(full), "=", old.Revision)
+		}
+		txnresp, err := s.client.Txn(ctx).If(cmp).Then(
+			v3.OpPut(full, val),
+			v3.OpGet(full),
+		).Else(
+			v3.OpGet(full),
+		).Commit()
+		if err != nil {
+			return nil, err
+		}
+		getResp := txnresp.Responses[len(txnresp.Responses)-1].GetResponseRange()
+		if txnresp.Succeeded {
+			return s.toKeyValue(getResp.Kvs[0]), nil
+		}
+		// modified by another client, retry on the current value
+		old = nil
+		if len(getResp.Kvs) != 0 {
+			old = s.toKeyValue(getResp.Kvs[0])
+		}
+	}
+}
+
+// commit applies op if key exists and, unless rev is zero, is still at rev
+func (s *Store) commit(ctx context.Context, key string, rev int64, op v3.Op) (*v3.TxnResponse, error) {
+	full := s.fullKey(key)
+	cmp := v3.Compare(v3.CreateRevision(full), ">", 0)
+	if rev != 0 {
+		cmp = v3.Compare(v3.ModRevision(full), "=", rev)
+	}
+	txnresp, err := s.client.Txn(ctx).If(cmp).Then(op).Else(v3.OpGet(full)).Commit()
+	if err != nil {
+		return nil, err
+	}
+	if !txnresp.Succeeded {
+		if len(txnresp.Responses[0].GetResponseRange().Kvs) == 0 {
+			return nil, ErrKeyNotFound
+		}
+		return nil, ErrConflict
+	}
+	return txnresp, nil
+}
+
+func (s *Store) fullKey(key string) string {
+	return strings.Join([]string{s.prefix, strings.TrimPrefix(key, "/")}, "/")
+}
+
+func (s *Store) toKeyValue(kv *mvccpb.KeyValue) *KeyValue {
+	return &KeyValue{
+		Key:            strings.TrimPrefix(string(kv.Key), s.prefix+"/"),
+		Value:          string(kv.Value),
+		Revision:       kv.ModRevision,
+		CreateRevision: kv.CreateRevision,
+		Version:        kv.Version,
+	}
+}
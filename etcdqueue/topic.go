@@ -0,0 +1,237 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"go.uber.org/zap"
+)
+
+const (
+	// messagesDir holds the published messages, <topic>/messages/<id>
+	messagesDir = "messages"
+	// groupsDir holds the queues of the consumer groups, <topic>/groups/<group>
+	groupsDir = "groups"
+	// offsetsDir holds the committed offsets of the groups, <topic>/offsets/<group>
+	offsetsDir = "offsets"
+
+	fanOutBatchSize = 100
+)
+
+// Topic delivers every published message to every consumer group. Each group
+// has a queue, <topic>/groups/<group>, into which the messages are copied in
+// publish order, and the members of a group share the messages by dequeuing
+// from it.
+type Topic struct {
+	client *v3.Client
+	prefix string
+}
+
+// ConsumerGroup is a consumer group of a topic. The group offset is the create
+// revision of the last message copied into the group queue.
+type ConsumerGroup struct {
+	topic *Topic
+	name  string
+	queue *Queue
+}
+
+// NewTopic new a topic
+func NewTopic(client *v3.Client, prefix string) *Topic {
+	return &Topic{client: client, prefix: prefix}
+}
+
+// NewEtcdTopic new a topic with a new etcd client
+func NewEtcdTopic(etcdConfig *EtcdConfig, prefix string) (*Topic, error) {
+	etcdClient, err := NewETCDClient(etcdConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to new etcd client, err: %v", err)
+	}
+	return NewTopic(etcdClient, prefix), nil
+}
+
+// Publish puts a message and returns its revision
+func (t *Topic) Publish(ctx context.Context, val string) (int64, error) {
+	rkv, err := newUniqueKV(ctx, t.client, t.messagesKey(), val)
+	if err != nil {
+		return 0, err
+	}
+	return rkv.Revision(), nil
+}
+
+// CreateGroup creates a consumer group which receives the messages published
+// from now on, or returns the group if it exists. opts configure the group queue.
+func (t *Topic) CreateGroup(ctx context.Context, name string, opts ...QueueOption) (*ConsumerGroup, error) {
+	g := t.Group(name, opts...)
+	resp, err := t.client.Get(ctx, t.messagesKey()+"/", v3.WithPrefix(), v3.WithCountOnly())
+	if err != nil {
+		return nil, err
+	}
+	rev := strconv.FormatInt(resp.Header.Revision, 10)
+	if _, err := putNewKV(ctx, t.client, g.offsetKey(), rev, v3.NoLease); err != nil && err != ErrKeyExists {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Group returns an existing consumer group
+func (t *Topic) Group(name string, opts ...QueueOption) *ConsumerGroup {
+	return &ConsumerGroup{
+		topic: t,
+		name:  name,
+		queue: NewQueue(t.client, strings.Join([]string{t.prefix, groupsDir, name}, "/"), opts...),
+	}
+}
+
+// Groups returns the names of the consumer groups
+func (t *Topic) Groups(ctx context.Context) ([]string, error) {
+	offsets, err := t.offsets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(offsets))
+	for name := range offsets {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Trim deletes the messages which were copied to every group and returns the
+// number of deleted messages.
+func (t *Topic) Trim(ctx context.Context) (int64, error) {
+	offsets, err := t.offsets(ctx)
+	if err != nil || len(offsets) == 0 {
+		return 0, err
+	}
+	var min int64 = -1
+	for _, off := range offsets {
+		if min < 0 || off < min {
+			min = off
+		}
+	}
+	resp, err := t.client.Get(ctx, t.messagesKey()+"/", v3.WithPrefix(), v3.WithKeysOnly(),
+		v3.WithMaxCreateRev(min))
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, kv := range resp.Kvs {
+		ok, err := deleteRevKey(ctx, t.client, string(kv.Key), kv.ModRevision)
+		if err != nil {
+			return n, err
+		} else if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// offsets returns the offsets of the groups by name
+func (t *Topic) offsets(ctx context.Context) (map[string]int64, error) {
+	prefix := strings.Join([]string{t.prefix, offsetsDir}, "/") + "/"
+	resp, err := t.client.Get(ctx, prefix, v3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[string]int64)
+	for _, kv := range resp.Kvs {
+		off, err := strconv.ParseInt(string(kv.Value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset %s, err: %v", kv.Key, err)
+		}
+		offsets[strings.TrimPrefix(string(kv.Key), prefix)] = off
+	}
+	return offsets, nil
+}
+
+func (t *Topic) messagesKey() string {
+	return strings.Join([]string{t.prefix, messagesDir}, "/")
+}
+
+// Name returns the group name
+func (g *ConsumerGroup) Name() string { return g.name }
+
+// Queue returns the group queue, members receive messages by Dequeue,
+// Reserve or a Consumer on it
+func (g *ConsumerGroup) Queue() *Queue { return g.queue }
+
+// Offset returns the committed offset of the group
+func (g *ConsumerGroup) Offset(ctx context.Context) (int64, error) {
+	off, _, err := g.getOffset(ctx)
+	return off, err
+}
+
+// Run copies the messages published after the group offset into the group
+// queue until ctx is done. Every member may run it, the offset is advanced in
+// the same txn as the copy with a compare on its revision, so each message is
+// copied once.
+func (g *ConsumerGroup) Run(ctx context.Context) error {
+	for {
+		rev, err := g.fanOut(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = WaitPrefixEvents(ctx, g.topic.client, g.topic.messagesKey()+"/", rev+1,
+			[]mvccpb.Event_EventType{mvccpb.PUT})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// fanOut copies the pending messages and returns the revision it read them at
+func (g *ConsumerGroup) fanOut(ctx context.Context) (int64, error) {
+	for {
+		off, offRev, err := g.getOffset(ctx)
+		if err != nil {
+			return 0, err
+		}
+		resp, err := g.topic.client.Get(ctx, g.topic.messagesKey()+"/", v3.WithPrefix(),
+			v3.WithMinCreateRev(off+1), v3.WithSort(v3.SortByCreateRevision, v3.SortAscend),
+			v3.WithLimit(fanOutBatchSize))
+		if err != nil {
+			return 0, err
+		}
+		if len(resp.Kvs) == 0 {
+			return resp.Header.Revision, nil
+		}
+		for _, kv := range resp.Kvs {
+			cmp := v3.Compare(v3.ModRevision(g.offsetKey()), "=", offRev)
+			next := strconv.FormatInt(kv.CreateRevision, 10)
+			newKey, txnresp, err := g.queue.putItem(ctx, string(kv.Value), []v3.Cmp{cmp},
+				func(string) []v3.Op { return []v3.Op{v3.OpPut(g.offsetKey(), next)} })
+			if err != nil {
+				return 0, err
+			}
+			if newKey == "" {
+				// another member advanced the offset, read it again
+				break
+			}
+			offRev = txnresp.Header.Revision
+			zap.S().Debugf("copied message %s to group %s", kv.Key, g.name)
+		}
+	}
+}
+
+// getOffset returns the offset and the revision of the offset key
+func (g *ConsumerGroup) getOffset(ctx context.Context) (int64, int64, error) {
+	resp, err := g.topic.client.Get(ctx, g.offsetKey())
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, 0, fmt.Errorf("group %s of topic %s does not exist", g.name, g.topic.prefix)
+	}
+	off, err := strconv.ParseInt(string(resp.Kvs[0].Value), 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid offset %s, err: %v", resp.Kvs[0].Key, err)
+	}
+	return off, resp.Kvs[0].ModRevision, nil
+}
+
+func (g *ConsumerGroup) offsetKey() string {
+	return strings.Join([]string{g.topic.prefix, offsetsDir, g.name}, "/")
+}
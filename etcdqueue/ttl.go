@@ -0,0 +1,128 @@
+package etcdqueue
+
+import (
+	"context"
+	"math"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"go.uber.org/zap"
+)
+
+// EnqueueWithTTL puts a value which is deleted by etcd if it is not dequeued
+// within ttl, and returns its key
+func (q *Queue) EnqueueWithTTL(val string, ttl time.Duration) (string, error) {
+	return q.EnqueueWithTTLCtx(q.ctx, val, ttl)
+}
+
+// EnqueueWithTTLCtx is EnqueueWithTTL with a context. The item is bound to a
+// lease of ttl, rounded up to seconds. The TTL ends with the dequeue, an item
+// which is reserved or requeued is kept until it is acked.
+func (q *Queue) EnqueueWithTTLCtx(ctx context.Context, val string, ttl time.Duration) (string, error) {
+	seconds := int64(math.Ceil(ttl.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	start := time.Now()
+	lease, err := q.client.Grant(ctx, seconds)
+	if err != nil {
+		return "", err
+	}
+	newKey, _, err := q.putLeasedItem(ctx, val, lease.ID, nil, nil)
+	if err != nil {
+		// the unused lease expires by itself if the revoke fails
+		q.client.Revoke(ctx, lease.ID)
+		return "", err
+	}
+	q.observeEnqueue(start, 1)
+	return newKey, nil
+}
+
+// RunExpiryWatcher calls onExpired, if not nil, with every item enqueued by
+// EnqueueWithTTL which expired before it was dequeued, and counts it in the
+// expired_total metric, until ctx is done. A deleted item expired if its lease
+// is gone, so an item dequeued just before its TTL may also be reported. The
+// watch resumes from the last seen revision after it is closed or fails, the
+// items which expired in a compacted revision are not reported.
+func (q *Queue) RunExpiryWatcher(ctx context.Context, onExpired func(item *Item)) error {
+	resp, err := q.getItems(ctx, v3.WithCountOnly())
+	if err != nil {
+		return err
+	}
+
+	rev := resp.Header.Revision + 1
+	start, end := q.itemRange()
+	for ctx.Err() == nil {
+		ctx1, cancel := context.WithCancel(ctx)
+		wc := q.client.Watch(ctx1, start, v3.WithRange(end), v3.WithRev(rev),
+			v3.WithPrevKV(), v3.WithFilterPut())
+		var werr error
+		for wresp := range wc {
+			if wresp.CompactRevision != 0 {
+				zap.S().Warnf("expiry watch of queue %s compacted at %d, the expired items before are not reported",
+					q.keyPrefix, wresp.CompactRevision)
+				rev = wresp.CompactRevision
+				break
+			}
+			if werr = wresp.Err(); werr != nil {
+				break
+			}
+			if err := q.reportExpired(ctx, wresp.Events, onExpired); err != nil {
+				werr = err
+				break
+			}
+			if n := len(wresp.Events); n > 0 {
+				rev = wresp.Events[n-1].Kv.ModRevision + 1
+			}
+		}
+		cancel()
+		if ctx.Err() != nil {
+			break
+		}
+		if werr != nil {
+			zap.S().Errorf("expiry watch of queue %s failed at revision %d, err: %v", q.keyPrefix, rev, werr)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(watchRetryInterval):
+		}
+	}
+	return ctx.Err()
+}
+
+// reportExpired reports the deleted leased items of evs whose lease is gone.
+// The live leases are listed once for all events instead of once per item,
+// before any item is reported, so a failed list is retried with all of them.
+func (q *Queue) reportExpired(ctx context.Context, evs []*v3.Event, onExpired func(item *Item)) error {
+	var deleted []*mvccpb.KeyValue
+	for _, ev := range evs {
+		if ev.Type == mvccpb.DELETE && ev.PrevKv != nil && ev.PrevKv.Lease != 0 {
+			deleted = append(deleted, ev.PrevKv)
+		}
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+	resp, err := q.client.Leases(ctx)
+	if err != nil {
+		return err
+	}
+	live := make(map[int64]bool, len(resp.Leases))
+	for _, l := range resp.Leases {
+		live[int64(l.ID)] = true
+	}
+
+	for _, kv := range deleted {
+		if live[kv.Lease] {
+			// dequeued, the lease outlives the item
+			continue
+		}
+		zap.S().Debugf("item %s expired before it was dequeued", kv.Key)
+		q.metrics.expire(q.keyPrefix)
+		if onExpired != nil {
+			onExpired(decodeItem(kv))
+		}
+	}
+	return nil
+}
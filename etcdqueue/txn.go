@@ -0,0 +1,161 @@
+package etcdqueue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v3 "github.com/coreos/etcd/clientv3"
+)
+
+// queueBatch is the values to put at the tail of a queue
+type queueBatch struct {
+	q    *Queue
+	vals []string
+}
+
+// putBatches puts all batches in one txn along with ops if cmps hold, and
+// returns the new keys by batch, or nil if cmps failed. Like putItem, it
+// retries with other keys if the allocated keys are taken meanwhile. Every
+// put counts against the server --max-txn-ops (128 by default).
+func putBatches(ctx context.Context, client *v3.Client, batches []queueBatch, cmps []v3.Cmp,
+	ops ...v3.Op) ([][]string, error) {
+	seen := make(map[string]bool)
+	for _, b := range batches {
+		if seen[b.q.keyPrefix] {
+			return nil, fmt.Errorf("queue %s is given more than once", b.q.keyPrefix)
+		}
+		seen[b.q.keyPrefix] = true
+	}
+
+	for {
+		var guards []v3.Cmp
+		puts := append([]v3.Op{}, ops...)
+		keys := make([][]string, 0, len(batches))
+		for _, b := range batches {
+			newKeys, bguards, bputs, err := b.q.allocKeys(ctx, len(b.vals))
+			if err != nil {
+				return nil, err
+			}
+			for i, val := range b.vals {
+				puts = append(puts, v3.OpPut(newKeys[i], val))
+			}
+			guards = append(guards, bguards...)
+			puts = append(puts, bputs...)
+			keys = append(keys, newKeys)
+		}
+		txnresp, err := client.Txn(ctx).If(cmps...).Then(v3.OpTxn(guards, puts, nil)).Commit()
+		if err != nil {
+			return nil, err
+		}
+		if !txnresp.Succeeded {
+			return nil, nil
+		}
+		if txnresp.Responses[0].GetResponseTxn().Succeeded {
+			return keys, nil
+		}
+		// new keys already exist or a counter moved, retry with others
+	}
+}
+
+// EnqueueBatch puts vals at the tail of the queue in one txn, either all or
+// none of them are enqueued. The items of a batch share a create revision, so
+// with OrderTimestamp they may be dequeued in any order among themselves, use
+// OrderSequence to keep it.
+//
+// A txn is limited by the server --max-txn-ops, 128 by default, of which the
+// nested txn of the puts gets one less. That allows 127 values with
+// OrderTimestamp and 126 with OrderSequence, whose counter takes one op. A
+// larger batch fails with ErrTooManyOps and nothing is put, split it into
+// several batches.
+func (q *Queue) EnqueueBatch(ctx context.Context, vals []string) ([]string, error) {
+	if len(vals) == 0 {
+		return nil, nil
+	}
+	start := time.Now()
+	keys, err := putBatches(ctx, q.client, []queueBatch{{q: q, vals: vals}}, nil)
+	if err != nil {
+		return nil, err
+	}
+	q.observeEnqueue(start, len(vals))
+	return keys[0], nil
+}
+
+// DequeueTo moves the first item to the tail of every queue of dsts in one
+// txn, the item is claimed by a revision compare like deleteRevKey, so it is
+// either moved or left in the queue. If the queue is empty, DequeueTo blocks
+// until elements are available or ctx is done. It returns the dequeued item,
+// the moved copies start with no attempts.
+func (q *Queue) DequeueTo(ctx context.Context, dsts ...*Queue) (*Item, error) {
+	if len(dsts) == 0 {
+		return nil, fmt.Errorf("no queue to move to")
+	}
+	seen := map[string]bool{q.keyPrefix: true}
+	for _, dst := range dsts {
+		if seen[dst.keyPrefix] {
+			return nil, fmt.Errorf("can not move queue %s to %s", q.keyPrefix, dst.keyPrefix)
+		}
+		seen[dst.keyPrefix] = true
+	}
+	start := time.Now()
+	for {
+		resp, err := q.getItems(ctx, q.orderOpts(), v3.WithLimit(1))
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Kvs) == 0 {
+			// nothing yet; wait on elements
+			if _, err := q.waitItemPut(ctx, resp.Header.Revision); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		kv := resp.Kvs[0]
+		item := decodeItem(kv)
+		batches := make([]queueBatch, 0, len(dsts))
+		for _, dst := range dsts {
+			batches = append(batches, queueBatch{q: dst, vals: []string{item.Value}})
+		}
+		cmp := v3.Compare(v3.ModRevision(string(kv.Key)), "=", kv.ModRevision)
+		keys, err := putBatches(ctx, q.client, batches, []v3.Cmp{cmp}, v3.OpDelete(string(kv.Key)))
+		if err != nil {
+			return nil, err
+		}
+		if keys == nil {
+			// claimed by another client, read the next one
+			q.metrics.claimConflict(q.keyPrefix, 1)
+			continue
+		}
+		q.observeDequeue("dequeue_to", start, 1)
+		for _, dst := range dsts {
+			dst.observeEnqueue(start, 1)
+		}
+		q.releaseDedup(ctx, item)
+		return item, nil
+	}
+}
+
+// AckTo acks the reserved item and puts vals at the tail of dst in one txn,
+// so that a pipeline stage hands its results to the next stage without
+// losing or duplicating them on a crash. It returns the new keys, or
+// ErrNotReserved if the item was redelivered before the ack.
+func (r *Reservation) AckTo(ctx context.Context, dst *Queue, vals ...string) ([]string, error) {
+	if len(vals) == 0 {
+		return nil, r.Ack(ctx)
+	}
+	defer r.session.Close()
+	start := time.Now()
+	cmp := v3.Compare(v3.ModRevision(r.inflightKey), "=", r.inflightRev)
+	keys, err := putBatches(ctx, r.q.client, []queueBatch{{q: dst, vals: vals}}, []v3.Cmp{cmp},
+		v3.OpDelete(r.inflightKey), v3.OpDelete(r.lease.Key()))
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		return nil, ErrNotReserved
+	}
+	dst.observeEnqueue(start, len(vals))
+	r.q.releaseDedup(ctx, r.item)
+	return keys[0], nil
+}
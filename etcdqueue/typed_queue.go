@@ -0,0 +1,87 @@
+package etcdqueue
+
+import (
+	"context"
+	"errors"
+)
+
+// TypedQueue wraps a Queue to enqueue and dequeue values of type T, encoded
+// with a Codec.
+type TypedQueue[T any] struct {
+	queue *Queue
+	codec Codec
+}
+
+// NewTypedQueue new a typed queue on top of queue
+func NewTypedQueue[T any](queue *Queue, codec Codec) *TypedQueue[T] {
+	return &TypedQueue[T]{queue: queue, codec: codec}
+}
+
+// Queue returns the underlying queue
+func (tq *TypedQueue[T]) Queue() *Queue { return tq.queue }
+
+// Enqueue encodes and puts a value into the queue
+func (tq *TypedQueue[T]) Enqueue(ctx context.Context, v T) error {
+	data, err := tq.codec.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tq.queue.EnqueueCtx(ctx, string(data))
+}
+
+// Dequeue returns and removes the first value. The value is removed even if it
+// can not be decoded, in which case a *DecodeError holding the raw value is returned.
+func (tq *TypedQueue[T]) Dequeue(ctx context.Context) (T, error) {
+	v, _, err := tq.DequeueItem(ctx)
+	return v, err
+}
+
+// DequeueItem is Dequeue which also returns the item, to Requeue it on failure
+func (tq *TypedQueue[T]) DequeueItem(ctx context.Context) (T, *Item, error) {
+	item, err := tq.queue.DequeueItem(ctx)
+	if err != nil {
+		var v T
+		return v, nil, err
+	}
+	v, err := tq.decode(item)
+	return v, item, err
+}
+
+// DequeueN returns and removes up to n values like Queue.DequeueN. The values
+// which can not be decoded are skipped and reported as joined *DecodeError.
+func (tq *TypedQueue[T]) DequeueN(ctx context.Context, n int) ([]T, error) {
+	items, err := tq.queue.dequeueItems(ctx, n)
+	vals, derr := tq.decodeAll(items)
+	return vals, errors.Join(err, derr)
+}
+
+// Peek returns up to n values in Dequeue order without removing them
+func (tq *TypedQueue[T]) Peek(ctx context.Context, n int) ([]T, error) {
+	items, err := tq.queue.Peek(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+	return tq.decodeAll(items)
+}
+
+func (tq *TypedQueue[T]) decodeAll(items []*Item) ([]T, error) {
+	res := make([]T, 0, len(items))
+	var errs []error
+	for _, item := range items {
+		v, err := tq.decode(item)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		res = append(res, v)
+	}
+	return res, errors.Join(errs...)
+}
+
+func (tq *TypedQueue[T]) decode(item *Item) (T, error) {
+	var v T
+	if err := tq.codec.Unmarshal([]byte(item.Value), &v); err != nil {
+		return v, &DecodeError{Key: item.Key, Value: []byte(item.Value), Err: err}
+	}
+	return v, nil
+}
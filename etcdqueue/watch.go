@@ -23,13 +23,20 @@ import (
 
 // WaitEvents waits on a key until it observes the given events and returns the final one.
 func WaitEvents(c *clientv3.Client, key string, rev int64, evs []mvccpb.Event_EventType) (*clientv3.Event, error) {
-	ctx, cancel := context.WithCancel(context.Background())
+	return WaitEventsCtx(context.Background(), c, key, rev, evs)
+}
+
+// WaitEventsCtx is WaitEvents with a context, it returns the ctx error if ctx
+// is done before the events are observed.
+func WaitEventsCtx(ctx context.Context, c *clientv3.Client, key string, rev int64,
+	evs []mvccpb.Event_EventType) (*clientv3.Event, error) {
+	ctx1, cancel := context.WithCancel(ctx)
 	defer cancel()
-	wc := c.Watch(ctx, key, clientv3.WithRev(rev))
+	wc := c.Watch(ctx1, key, clientv3.WithRev(rev))
 	if wc == nil {
 		return nil, ErrNoWatcher
 	}
-	return waitEvents(wc, evs), nil
+	return waitEvents(ctx1, wc, evs)
 }
 
 // wait prefix events
@@ -41,20 +48,40 @@ func WaitPrefixEvents(ctx context.Context, c *clientv3.Client, prefix string, re
 	if wc == nil {
 		return nil, ErrNoWatcher
 	}
-	return waitEvents(wc, evs), nil
+	return waitEvents(ctx1, wc, evs)
+}
+
+// WaitRangeEvents waits on the key range [key, end) until it observes the given events and returns the final one.
+func WaitRangeEvents(ctx context.Context, c *clientv3.Client, key, end string, rev int64,
+	evs []mvccpb.Event_EventType) (*clientv3.Event, error) {
+	ctx1, cancel := context.WithCancel(ctx)
+	defer cancel()
+	wc := c.Watch(ctx1, key, clientv3.WithRange(end), clientv3.WithRev(rev))
+	if wc == nil {
+		return nil, ErrNoWatcher
+	}
+	return waitEvents(ctx1, wc, evs)
 }
 
-func waitEvents(wc clientv3.WatchChan, evs []mvccpb.Event_EventType) *clientv3.Event {
+// waitEvents returns the ctx error if ctx is done before the events are
+// observed, and ErrWatchClosed if the watch is closed for any other reason.
+func waitEvents(ctx context.Context, wc clientv3.WatchChan, evs []mvccpb.Event_EventType) (*clientv3.Event, error) {
 	i := 0
 	for wresp := range wc {
+		if err := wresp.Err(); err != nil {
+			return nil, err
+		}
 		for _, ev := range wresp.Events {
 			if ev.Type == evs[i] {
 				i++
 				if i == len(evs) {
-					return ev
+					return ev, nil
 				}
 			}
 		}
 	}
-	return nil
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrWatchClosed
 }